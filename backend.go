@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Внешнее хранилище второго уровня (Redis, memcached и т.п.), общее для нескольких экземпляров.
+	// Элементы идентифицируются строковым hash (Elem.Hash), поэтому HashFunc должна давать одинаковый результат
+	// во всех экземплярах (FNV по умолчанию - даёт). Код хранится вместе с данными, так как без него
+	// данные из хранилища нельзя вернуть так же, как из кеша.
+	// Методы вызываются без блокировок кеша, могут вызываться одновременно и должны быть потокобезопасными
+	Backend interface {
+		// Данные по hash. ttl - оставшееся время жизни, <= 0 - без устаревания. ok == false - данных нет
+		Load(hash string) (data any, code int, ttl time.Duration, ok bool, err error)
+		// Сохранение данных после Commit. ttl <= 0 - без устаревания
+		Store(hash string, data any, code int, ttl time.Duration) error
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Попытка заполнить полученный на заполнение элемент из Backend, вызывается без блокировки.
+// true - элемент заполнен, отдавать его на заполнение не надо
+func (e *Elem) loadFromBackend(id uint64) (data any, code int, ok bool) {
+	backend := e.cache.backend
+	if backend == nil {
+		return
+	}
+
+	data, code, ttl, ok, err := backend.Load(e.Hash)
+	if err != nil {
+		e.cache.message(log.ERR, `[%d] "%s": backend load: %s`, id, e.Key, err)
+		return nil, 0, false
+	}
+
+	if !ok {
+		return nil, 0, false
+	}
+
+	lifetime := config.Duration(ttl)
+	if ttl <= 0 {
+		lifetime = LifetimeForever
+	}
+
+	e.CommitEx(id, data, code, lifetime, &CommitOptions{fromBackend: true})
+	return e.cache.cloneData(e.Key, data), code, true
+}
+
+// Запись в Backend после Commit, вызывается после снятия блокировки
+func (c *Cache) storeToBackend(id uint64, key string, hash string, data any, code int, lifetime config.Duration) {
+	err := c.backend.Store(hash, data, code, lifetime.D())
+	if err != nil {
+		c.message(log.ERR, `[%d] "%s": backend store: %s`, id, key, err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
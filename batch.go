@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"github.com/alrusov/config"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Ключ для BatchGet
+	KeySpec struct {
+		Key         string
+		Description string
+		Extra       []any
+	}
+
+	// Результат BatchGet для одного ключа, поля - как у результатов Get
+	BatchResult struct {
+		Elem *Elem // Требует заполнения (Commit или Abort), nil - не требует
+		Data any
+		Code int // CodeInProgress - заполняется другим
+	}
+
+	// Данные для BatchCommit. Элемент задаётся полученным на заполнение Elem или, если он nil, значением Elem.Hash
+	CommitSpec struct {
+		Elem     *Elem
+		Hash     string
+		Data     any
+		Code     int
+		Lifetime config.Duration
+		Options  *CommitOptions // Как в CommitEx, nil - без дополнительных параметров
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Получение нескольких ключей с одной блокировкой на каждую затронутую часть хранилища.
+// Результаты - в порядке keys. Для каждого ключа всё как в Get, кроме ожидания: если ключ заполняется другим,
+// то BatchGet его не ждёт, а возвращает Elem == nil и Code == CodeInProgress.
+// Иначе два BatchGet, захватившие на заполнение ключи друг друга, ждали бы друг друга вечно.
+// Такие ключи надо получить через Get после того, как все полученные на заполнение элементы сохранены или отменены.
+// Одинаковые ключи в keys не допускаются - второй окажется заполняемым первым и получит CodeInProgress.
+// Отданные на заполнение, как и в Get, сначала ищутся в Backend.
+// Ограничение MaxConcurrentFills к BatchGet не применяется - предполагается, что недостающее заполняется одним запросом
+func BatchGet(id uint64, keys []KeySpec) []BatchResult {
+	return Global().BatchGet(id, keys)
+}
+
+func (c *Cache) BatchGet(id uint64, keys []KeySpec) (result []BatchResult) {
+	result = make([]BatchResult, len(keys))
+
+	type item struct {
+		idx   int
+		hkey  hashKey
+		hash  string
+		check uint64
+	}
+
+	groups := make(map[*shard][]item, len(c.shards))
+	for i, k := range keys {
+		hkey, hash, check := c.mustHash(k.Key, k.Extra)
+		s := c.shard(hkey)
+		groups[s] = append(groups[s], item{idx: i, hkey: hkey, hash: hash, check: check})
+	}
+
+	opts := &getOptions{noWait: true}
+
+	for s, items := range groups {
+		s.Lock()
+		for _, it := range items {
+			k := &keys[it.idx]
+			r := &result[it.idx]
+			r.Elem, r.Data, r.Code, _, _ = c.getLocked(s, id, k.Key, k.Description, it.hkey, it.hash, it.check, opts)
+		}
+		s.unlock()
+	}
+
+	// Как и в Get, отданные на заполнение сначала пробуем заполнить из Backend (без блокировки)
+	for i := range result {
+		r := &result[i]
+		if r.Elem == nil {
+			continue
+		}
+
+		if data, code, ok := r.Elem.loadFromBackend(id); ok {
+			r.Elem, r.Data, r.Code = nil, data, code
+		}
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Сохранение нескольких элементов с одной блокировкой на каждую затронутую часть хранилища,
+// например, для недостающих после BatchGet, заполненных одним запросом. Для каждого элемента всё как в CommitEx,
+// ожидающие всех сохранённых элементов просыпаются. Ошибки - в порядке specs, nil - сохранено.
+// Элемент, заданный hash, должен находиться в хранилище в процессе заполнения, иначе ErrNotInProgress
+func BatchCommit(id uint64, specs []CommitSpec) []error {
+	return Global().BatchCommit(id, specs)
+}
+
+func (c *Cache) BatchCommit(id uint64, specs []CommitSpec) (errs []error) {
+	errs = make([]error, len(specs))
+
+	type item struct {
+		idx  int
+		hkey hashKey // Только для заданных hash
+	}
+
+	groups := make(map[*shard][]item, len(c.shards))
+	for i := range specs {
+		sp := &specs[i]
+		if sp.Elem != nil {
+			groups[sp.Elem.shard] = append(groups[sp.Elem.shard], item{idx: i})
+			continue
+		}
+
+		hkey := c.hashKey(sp.Hash)
+		s := c.shard(hkey)
+		groups[s] = append(groups[s], item{idx: i, hkey: hkey})
+	}
+
+	for s, items := range groups {
+		s.Lock()
+		for _, it := range items {
+			sp := &specs[it.idx]
+
+			e := sp.Elem
+			if e == nil {
+				var exists bool
+				if e, exists = s.data[it.hkey]; !exists || e.InProgressFrom.IsZero() {
+					errs[it.idx] = ErrNotInProgress
+					continue
+				}
+			}
+
+			_, errs[it.idx] = e.commitLocked(id, sp.Data, sp.Code, sp.Lifetime, sp.Options)
+		}
+		s.unlock()
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -1,8 +1,20 @@
+// Кеш с однократным заполнением: при одновременном обращении к отсутствующему элементу
+// заполняет его кто-то один, остальные ждут.
+//
+// Функции пакета работают с глобальным кешем, который создаётся при инициализации модуля (initializer),
+// а при её отсутствии - при первом обращении. Независимые кеши создаются через New() или NewWithConfig()
+// и используются через методы *Cache, глобальный кеш для них не нужен.
 package cache
 
 import (
+	"container/list"
+	"context"
+	"errors"
+	"math/rand"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alrusov/config"
@@ -10,50 +22,175 @@ import (
 	"github.com/alrusov/jsonw"
 	"github.com/alrusov/log"
 	"github.com/alrusov/misc"
+	"github.com/alrusov/panic"
 )
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
 type (
 	Cache struct {
-		sync.Mutex
-		data Elems
+		name                 string                // Имя для статистики и журнала
+		shards               []*shard              // Части хранилища со своими блокировками
+		initialCapacity      int                   // Начальный размер хранилища (на часть)
+		gcInterval           atomic.Int64          // Интервал между проходами сборщика мусора (time.Duration)
+		gcRetentionFactor    float64               // Сборщик мусора удаляет элемент через столько времён жизни после обновления
+		defaultLifetime      config.Duration       // Время жизни, если в Commit передано 0
+		negativeLifetime     config.Duration       // Время жизни отрицательного результата, если в Commit передано 0
+		maxLifetime          config.Duration       // Максимальное время жизни, 0 - без ограничений
+		grace                config.Duration       // Интервал между попытками обновления после неудачной в режиме Grace, 0 - выключен
+		lifetimeMultiplier   atomic.Uint64         // Множитель времени жизни (math.Float64bits), 0 - 1
+		fillTokens           atomic.Uint64         // Последний выданный FillToken
+		maxEntries           int                   // Максимальное количество элементов, 0 - без ограничений
+		maxBytes             int64                 // Максимальный суммарный размер данных, 0 - без ограничений
+		entries              atomic.Int64          // Количество элементов во всех частях
+		bytes                atomic.Int64          // Суммарный размер данных во всех частях
+		evictCursor          atomic.Uint64         // Часть, с которой начинается следующий проход evictGlobal
+		evictionPolicy       EvictionPolicy        // Политика вытеснения
+		hashFunc             HashFunc              // Функция вычисления hash
+		onEvict              EvictFunc             // Обработчик удаления элемента
+		onCommit             CommitFunc            // Обработчик сохранения данных
+		backend              Backend               // Хранилище второго уровня, nil - нет
+		onInvalidate         InvalidateFunc        // Обработчик явного удаления элементов
+		onStaleHit           StaleHitFunc          // Обработчик выдачи устаревших данных
+		clone                CloneFunc             // Копирование отдаваемых данных, nil - без копирования
+		codec                Codec                 // Кодирование хранимых []byte, nil - без кодирования
+		codecThreshold       int                   // Минимальный размер кодируемых данных
+		lifetimePolicy       LifetimePolicy        // Время жизни по коду, если в Commit передано 0
+		dedup                map[string]*dedupData // Общие данные по ContentHash, nil - Dedup выключен
+		dedupMutex           sync.Mutex            // Блокировка dedup
+		staleWhileRevalidate bool                  // GetOrSet отдаёт устаревшие данные сразу, обновляя их в фоне
+		refreshAhead         config.Duration       // GetOrSet обновляет данные в фоне, если до устаревания осталось меньше
+		jitterFraction       float64               // Доля времени жизни, на которую оно может быть случайно уменьшено
+		jitterRand           *rand.Rand            // Источник случайных чисел для разброса
+		jitterMutex          sync.Mutex            // Блокировка jitterRand
+		jitterSeed           int64                 // Начальное значение jitterRand, 0 - задан JitterSource
+		prefixLifetimes      []prefixLifetime      // Время жизни по умолчанию для ключей с префиксом, по убыванию длины префикса
+		prefixLifetimesMutex sync.RWMutex          // Блокировка prefixLifetimes
+		metrics              metrics               // Счётчики
+		done                 chan struct{}         // Закрывается в Close
+		closed               atomic.Bool           // Кеш закрыт
+		now                  func() time.Time      // Текущее время, misc.NowUTC - подменяется в тестах
+		log                  *log.Facility         // Журнал, по умолчанию - Log
+		fillSlots            chan struct{}         // Ограничение количества одновременных заполнений, nil - без ограничений
+		subscribers          subscribers           // Подписчики на события
+		flights              flights               // Общие заполнения GetCoalesced
+		historySize          int                   // Размер истории операций элемента, 0 - не ведётся
+		softEvictBytes       bool                  // При превышении MaxBytes освобождаются только данные элементов
 	}
 
+	// Не используется, оставлено для совместимости
 	Elems map[string]*Elem
 
+	elems map[hashKey]*Elem
+
 	Elem struct {
 		def
-		cond  *sync.Cond // Для ожидания первого заполнения
-		cache *Cache     // Ссылка на кеш
-		Data  any        `json:"-"` // Данные
+		cond         *sync.Cond    // Для ожидания первого заполнения
+		cache        *Cache        // Ссылка на кеш
+		shard        *shard        // Ссылка на часть хранилища, в которой находится элемент
+		hkey         hashKey       // Ключ в хранилище
+		lru          *list.Element // Место в порядке использования
+		waiters      int           // Количество ожидающих заполнения
+		check        uint64        // Контрольная сумма исходных данных hash, 0 - нет
+		fillSlot     bool          // Занято место в ограничении MaxConcurrentFills
+		deleted      bool          // Удалён (Delete и т.п.) во время заполнения, Commit ничего не сохраняет
+		dedup        bool          // Data общие с другими элементами (Config.Dedup)
+		history      *history      // Последние операции, nil - не ведётся
+		graceRetryAt time.Time     // Режим Grace: обновление не удалось, до этого времени отдаются имеющиеся данные
+		flight       *flight       // Общее заполнение (GetCoalesced), которое ведёт этот элемент
+		flightKey    string        // coalesceKey для flight
+		token        FillToken     // Токен текущего заполнения
+		Data         any           `json:"-"` // Данные, без Config.Clone - общие для всех получателей, изменять их нельзя
 	}
 
 	Stats []Stat
 
 	Stat struct {
 		def
+		Cache   string    `json:"cache,omitempty"` // Имя кеша (Config.Name)
+		Waiters int       `json:"waiters"`         // Количество ожидающих заполнения
+		Data    any       `json:"data,omitempty"`  // Данные, только в GetStatWithData
+		at      time.Time // Момент получения статистики по часам кеша
+	}
+
+	// Дополнительные параметры Commit
+	CommitOptions struct {
+		Tags        []string          // Теги для группового удаления (InvalidateTag), nil - оставить прежние, пустой - удалить
+		Size        int64             // Размер данных в байтах для ограничения MaxBytes, 0 - не учитывается
+		Negative    bool              // Отрицательный результат: по умолчанию живёт NegativeLifetime, GetOrSet не отдаёт его устаревшим и заранее не обновляет
+		Meta        map[string]string // Метаданные, видны в GetStat, копируются, nil - оставить прежние, пустые - удалить
+		ContentHash string            // hash содержимого: если совпадает с сохранённым, то данные не заменяются, а только продлеваются; в режиме Dedup - общие данные
+		Priority    int               // Приоритет при вытеснении: сначала вытесняются элементы с меньшим приоритетом, по умолчанию 0
+		Token       FillToken         // Токен заполнения (GetWithToken): если задан и не совпадает с текущим, то Commit отвергается с ErrNotOwner
+
+		fromBackend bool // Данные получены из Backend, записывать их туда не надо
+	}
+
+	// Параметры получения элемента
+	getOptions struct {
+		timeout    time.Duration   // Максимальное время ожидания заполнения другим, 0 - без ограничений
+		background bool            // Вызывающий может заполнять в фоне (GetOrSet)
+		ctx        context.Context // Отмена ожидания заполнения другим, nil - без отмены
+		noWait     bool            // Не ждать заполнения другим (BatchGet)
+		maxAge     time.Duration   // Данные, обновлённые раньше, считать устаревшими, 0 - по времени жизни
 	}
 
 	def struct {
-		Key             string          `json:"key"`             // Ключ
-		Description     string          `json:"description"`     // Дополнительное описание для визуализации
-		Hash            string          `json:"hash"`            // hash
-		Lifetime        config.Duration `json:"lifetime"`        // lifetime
-		CreatedAt       time.Time       `json:"createdAt"`       // Время первоначального создания
-		InProgressFrom  time.Time       `json:"inProgressFrom"`  // Время начала обновления
-		LastUpdatedAt   time.Time       `json:"lastUpdatedAt"`   // Время последнего обновления
-		ExparedAt       time.Time       `json:"exparedAt"`       // Время оуончания жизни
-		Filled          bool            `json:"filled"`          // Зполнено актуальными данными
-		Code            int             `json:"code"`            // code
-		NumberOfUpdates uint            `json:"numberOfUpdates"` // Количество обновлений
-		NumberOfUses    uint            `json:"numberOfUses"`    // Количество использований
+		Key             string            `json:"key"`                     // Ключ
+		Description     string            `json:"description"`             // Дополнительное описание для визуализации
+		Hash            string            `json:"hash"`                    // hash
+		Lifetime        config.Duration   `json:"lifetime"`                // lifetime
+		CreatedAt       time.Time         `json:"createdAt"`               // Время первоначального создания
+		CreatedBy       uint64            `json:"createdBy,omitempty"`     // id создавшего элемент (см. Get)
+		InProgressFrom  time.Time         `json:"inProgressFrom"`          // Время начала обновления
+		LastUpdatedAt   time.Time         `json:"lastUpdatedAt"`           // Время последнего обновления
+		LastUpdatedBy   uint64            `json:"lastUpdatedBy,omitempty"` // id выполнившего последнее обновление (Commit)
+		LastUsedAt      time.Time         `json:"lastUsedAt"`              // Время последнего использования
+		ExparedAt       time.Time         `json:"exparedAt"`               // Время оуончания жизни
+		Filled          bool              `json:"filled"`                  // Зполнено актуальными данными
+		Code            int               `json:"code"`                    // code
+		NumberOfUpdates uint64            `json:"numberOfUpdates"`         // Количество обновлений
+		NumberOfUses    uint64            `json:"numberOfUses"`            // Количество использований
+		Tags            []string          `json:"tags,omitempty"`          // Теги
+		Size            int64             `json:"size,omitempty"`          // Размер данных, указанный при Commit
+		Negative        bool              `json:"negative,omitempty"`      // Отрицательный результат (например, "не найдено")
+		Meta            map[string]string `json:"meta,omitempty"`          // Метаданные вызывающего (источник, ETag и т.п.)
+		ContentHash     string            `json:"contentHash,omitempty"`   // hash содержимого данных (CommitIfChanged)
+		Priority        int               `json:"priority,omitempty"`      // Приоритет при вытеснении
+		FillDuration    config.Duration   `json:"fillDuration,omitempty"`  // Длительность последнего заполнения (от выдачи на заполнение до Commit)
 	}
 )
 
+const (
+	LifetimeForever = config.Duration(-1) // Данные не устаревают
+)
+
+// Коды результата, которые формирует сам кеш. Коды, переданные в Commit (или полученные из Backend), возвращаются
+// как есть, в том числе отрицательные, поэтому по значению их не отличить: коды кеша возвращаются только без данных
+// (ok == false в Peek, TryGet и Take, e == nil и data == nil в Get, Elem == nil и Data == nil в BatchGet)
+const (
+	CodeOK         = 0  // Код по умолчанию
+	CodeTimeout    = -1 // Не дождались заполнения другим
+	CodeCanceled   = -2 // Ожидание заполнения другим прервано отменой контекста
+	CodeInProgress = -3 // Заполняется другим, а ждать нельзя (BatchGet)
+	CodeDeleted    = -4 // Удалён (Delete и т.п.) во время ожидания заполнения другим
+	CodeNotFound   = -5 // Нет подходящих данных (Peek, TryGet, Take с ok == false)
+
+	codeFirstInternal = CodeNotFound
+)
+
+var (
+	ErrClosed        = errors.New("cache is closed")              // Кеш закрыт, данные не сохраняются
+	ErrNotInProgress = errors.New("element is not in progress")   // Элемент уже сохранён или отменён
+	ErrHash          = errors.New("unable to calculate the hash") // Не удалось вычислить hash
+	ErrDeleted       = errors.New("element was deleted")          // Элемент удалён во время заполнения, данные не сохранены
+	ErrNotOwner      = errors.New("fill token mismatch")          // Токен не от текущего заполнения элемента (CommitOptions.Token)
+)
+
 var (
-	Log     = log.NewFacility("cache")
-	storage *Cache
+	Log          = log.NewFacility("cache")
+	storage      atomic.Pointer[Cache]
+	storageMutex sync.Mutex
 )
 
 //----------------------------------------------------------------------------------------------------------------------------//
@@ -65,7 +202,19 @@ func init() {
 
 // Инициализация
 func initModule(appCfg any, h any) (err error) {
-	storage = New()
+	var cfg *Config
+
+	if ac, ok := appCfg.(AppConfig); ok {
+		cfg = ac.CacheConfig()
+		if cfg != nil {
+			err = cfg.Check(appCfg)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	storage.Store(NewWithConfig(cfg))
 
 	Log.Message(log.INFO, "Initialized")
 	return
@@ -73,185 +222,1243 @@ func initModule(appCfg any, h any) (err error) {
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// Глобальный кеш. Если инициализация модуля не выполнялась, то он создаётся с настройками по умолчанию
+func Global() (c *Cache) {
+	c = storage.Load()
+	if c != nil {
+		return
+	}
+
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	c = storage.Load()
+	if c == nil {
+		c = New()
+		storage.Store(c)
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
 func New() (c *Cache) {
+	return NewWithConfig(nil)
+}
+
+// Новый кеш с заданными настройками, nil - настройки по умолчанию
+func NewWithConfig(cfg *Config) (c *Cache) {
+	var x Config
+	if cfg != nil {
+		x = *cfg
+	}
+	x.setDefaults()
+
 	c = &Cache{
-		data: make(Elems, 128),
+		shards:               make([]*shard, x.Shards),
+		initialCapacity:      (x.InitialCapacity + x.Shards - 1) / x.Shards,
+		gcRetentionFactor:    x.GCRetentionFactor,
+		defaultLifetime:      x.DefaultLifetime,
+		negativeLifetime:     x.NegativeLifetime,
+		maxLifetime:          x.MaxLifetime,
+		grace:                x.Grace,
+		evictionPolicy:       x.EvictionPolicy,
+		maxEntries:           x.MaxEntries,
+		maxBytes:             x.MaxBytes,
+		hashFunc:             x.HashFunc,
+		onEvict:              x.OnEvict,
+		onCommit:             x.OnCommit,
+		backend:              x.Backend,
+		onInvalidate:         x.OnInvalidate,
+		onStaleHit:           x.OnStaleHit,
+		name:                 x.Name,
+		clone:                x.Clone,
+		codec:                x.Codec,
+		codecThreshold:       x.CodecThreshold,
+		historySize:          x.HistorySize,
+		softEvictBytes:       x.SoftEvictBytes,
+		lifetimePolicy:       x.LifetimePolicy,
+		staleWhileRevalidate: x.StaleWhileRevalidate,
+		refreshAhead:         x.RefreshAhead,
+		jitterFraction:       x.JitterFraction,
+		done:                 make(chan struct{}),
+		now:                  misc.NowUTC,
+		log:                  x.Log,
+	}
+
+	if x.JitterSource != nil {
+		c.jitterRand = rand.New(x.JitterSource)
+	} else {
+		c.jitterSeed = x.JitterSeed
+		c.jitterRand = rand.New(rand.NewSource(x.JitterSeed))
 	}
 
-	go c.gc()
+	if x.Dedup {
+		c.dedup = make(map[string]*dedupData)
+	}
+
+	if c.log == nil {
+		c.log = Log
+		if x.LogName != "" {
+			c.log = log.NewFacility(x.LogName)
+		}
+	}
+
+	if x.MaxConcurrentFills > 0 {
+		c.fillSlots = make(chan struct{}, x.MaxConcurrentFills)
+	}
+
+	for i := range c.shards {
+		c.shards[i] = &shard{
+			cache: c,
+			data:  make(elems, c.initialCapacity),
+			lru:   list.New(),
+			tags:  make(map[string]map[hashKey]*Elem),
+		}
+		c.shards[i].filled = sync.NewCond(&c.shards[i].RWMutex)
+	}
+
+	c.SetGCInterval(x.GCInterval.D())
+
+	if x.DisableGC {
+		c.message(log.INFO, "gc is disabled")
+	} else {
+		go c.gc()
+	}
 
 	return c
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// Изменить интервал между проходами сборщика мусора, <= 0 - по умолчанию.
+// Работающий сборщик подхватит новое значение после очередного прохода
+func (c *Cache) SetGCInterval(d time.Duration) {
+	if d <= 0 {
+		d = DefaultGCInterval.D()
+	}
+
+	c.gcInterval.Store(int64(d))
+}
+
+// Текущее время по часам кеша, по нему определяется устаревание элементов
+func (c *Cache) Now() time.Time {
+	return c.now()
+}
+
+// Текущий интервал между проходами сборщика мусора
+func (c *Cache) GCInterval() time.Duration {
+	return time.Duration(c.gcInterval.Load())
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
 func (c *Cache) gc() {
-	Log.Message(log.INFO, "gc started")
+	c.message(log.INFO, "gc started")
 
 	for misc.AppStarted() {
-		c.Lock()
-		now := misc.NowUTC()
+		c.sweep()
 
-		for hash, e := range c.data {
-			if !e.InProgressFrom.IsZero() {
-				continue
-			}
+		timer := time.NewTimer(c.GCInterval())
+		select {
+		case <-c.done:
+			timer.Stop()
+			c.message(log.INFO, "gc stopped (closed)")
+			return
+		case <-timer.C:
+		}
+	}
 
-			if now.Sub(e.LastUpdatedAt) < 2*e.Lifetime.D() {
-				continue
-			}
+	c.message(log.INFO, "gc stopped")
+}
+
+// Один проход сборщика мусора, возвращает количество удалённых элементов
+func (c *Cache) sweep() (n int) {
+	c.forEachShard(func(s *shard) {
+		now := c.now()
 
-			delete(c.data, hash)
+		for _, e := range s.data {
+			if c.retired(e, now) {
+				s.remove(e)
+				e.debug(0, "removed by gc")
+				n++
+			}
 		}
 
-		c.Unlock()
-		misc.Sleep(60 * time.Second)
+		s.compact(compactRatio)
+	})
+
+	if n > 0 && c.log.CurrentLogLevel() >= log.DEBUG {
+		c.message(log.DEBUG, "gc: %d removed", n)
 	}
 
-	Log.Message(log.INFO, "gc stopped")
+	return
+}
+
+// Немедленный проход сборщика мусора по тем же правилам (включая GCRetentionFactor), не дожидаясь очередного.
+// Возвращает количество удалённых элементов
+func DeleteExpired() int {
+	return Global().DeleteExpired()
+}
+
+func (c *Cache) DeleteExpired() int {
+	return c.sweep()
+}
+
+// Элемент пора удалять сборщиком мусора: не заполняется, устаревает и после устаревания прошло
+// (GCRetentionFactor - 1) времён жизни. При GCRetentionFactor == 1 удаляется на первом проходе после устаревания.
+// Неустаревающие, помеченные устаревшими (Expire), держатся GCRetentionFactor времён жизни по умолчанию (не меньше GCInterval).
+// В режиме Grace элемент не удаляется до следующей попытки обновления, а время хранения отсчитывается от неё.
+// Вызывается под блокировкой
+func (c *Cache) retired(e *Elem, now time.Time) bool {
+	if !e.InProgressFrom.IsZero() || e.ExparedAt.IsZero() || now.Before(e.graceRetryAt) {
+		// Заполняется, не устаревает (в том числе освобождённый SoftEvict) или отдаётся в режиме Grace
+		return false
+	}
+
+	from := e.ExparedAt
+	if e.graceRetryAt.After(from) {
+		from = e.graceRetryAt
+	}
+
+	if e.Lifetime <= 0 {
+		// Неустаревающий, помеченный устаревшим (Expire), - своего времени жизни нет
+		base := max(c.defaultLifetime.D(), c.GCInterval())
+		return now.Sub(from) >= time.Duration(float64(base)*c.gcRetentionFactor)
+	}
+
+	return now.Sub(from) >= time.Duration(float64(e.Lifetime.D())*(c.gcRetentionFactor-1))
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// Код - один из кодов кеша (CodeTimeout, CodeNotFound и т.п.). Совпадающий код, переданный в Commit, неотличим по значению,
+// поэтому проверять имеет смысл только результаты без данных (см. коды выше)
+func IsInternalCode(code int) bool {
+	return code < CodeOK && code >= codeFirstInternal
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Получить данные или элемент для заполнения (e != nil), который надо сохранить (Commit) или отменить (Abort).
+// При заданном MaxConcurrentFills элемент отдаётся на заполнение, только когда одновременных заполнений меньше
+// ограничения, до этого вызывающий ждёт (остальные ожидающие этого ключа - тоже). Get и GetWithTimeout ждут без ограничения
+// времени, GetContext - до отмены ctx (тогда CodeCanceled). Заполняющий не должен получать на заполнение другие элементы,
+// пока не закончит со своим, иначе при исчерпании ограничения он будет ждать сам себя
 func Get(id uint64, key string, description string, extra ...any) (e *Elem, data any, code int) {
-	return storage.Get(id, key, description, extra...)
+	return Global().Get(id, key, description, extra...)
 }
 
 func (c *Cache) Get(id uint64, key string, description string, extra ...any) (e *Elem, data any, code int) {
-	c.Lock()
-	defer c.Unlock()
+	hkey, hash, check := c.mustHash(key, extra)
+	e, data, code, _, _ = c.get(id, key, description, hkey, hash, check, nil)
+	return
+}
 
-	now := misc.NowUTC()
+// То же, что и Get, но дополнительно сообщает, что отданные без заполнения данные устарели
+// (stale == true: время жизни истекло, но их в это время обновляет другой или действует Grace/StaleWhileRevalidate)
+func GetEx(id uint64, key string, description string, extra ...any) (e *Elem, data any, code int, stale bool) {
+	return Global().GetEx(id, key, description, extra...)
+}
 
-	hash := makeHash(key, extra)
-	e, exists := c.data[hash]
-	if !exists { // Не существует
-		// Создадим новый
-		e = &Elem{
-			cond:  sync.NewCond(&c.Mutex),
-			cache: c,
-			def: def{
-				Key:       key,
-				Hash:      hash,
-				CreatedAt: now,
-			},
+func (c *Cache) GetEx(id uint64, key string, description string, extra ...any) (e *Elem, data any, code int, stale bool) {
+	hkey, hash, check := c.mustHash(key, extra)
+	e, data, code, stale, _ = c.get(id, key, description, hkey, hash, check, nil)
+	return
+}
+
+// То же, что и Get, но ожидание заполнения другим ограничено timeout (0 - без ограничений).
+// Если за это время данные не появились, то возвращается e == nil, data == nil и code == CodeTimeout
+func GetWithTimeout(id uint64, timeout time.Duration, key string, description string, extra ...any) (e *Elem, data any, code int) {
+	return Global().GetWithTimeout(id, timeout, key, description, extra...)
+}
+
+func (c *Cache) GetWithTimeout(id uint64, timeout time.Duration, key string, description string, extra ...any) (e *Elem, data any, code int) {
+	hkey, hash, check := c.mustHash(key, extra)
+	e, data, code, _, _ = c.get(id, key, description, hkey, hash, check, &getOptions{timeout: timeout})
+	return
+}
+
+// То же, что и Get, но данные, обновлённые больше maxAge назад, считаются устаревшими для этого вызова,
+// даже если их время жизни не истекло, и элемент отдаётся на заполнение (0 - как в Get).
+// Если элемент в это время обновляет другой, отдаются имеющиеся данные, как и в Get.
+// На актуальность данных для других вызовов не влияет
+func GetMaxAge(id uint64, maxAge time.Duration, key string, description string, extra ...any) (e *Elem, data any, code int) {
+	return Global().GetMaxAge(id, maxAge, key, description, extra...)
+}
+
+func (c *Cache) GetMaxAge(id uint64, maxAge time.Duration, key string, description string, extra ...any) (e *Elem, data any, code int) {
+	hkey, hash, check := c.mustHash(key, extra)
+	e, data, code, _, _ = c.get(id, key, description, hkey, hash, check, &getOptions{maxAge: maxAge})
+	return
+}
+
+// То же, что и Get, но ожидание заполнения другим прерывается при отмене ctx.
+// В этом случае возвращается e == nil, data == nil, code == CodeCanceled и err == ctx.Err().
+// Кроме того, возвращает ошибки, которые Get только пишет в лог: ErrHash при невозможности вычислить hash
+// (тогда e == nil) и ErrClosed для закрытого кеша (тогда e можно заполнить, но данные не сохранятся).
+// Для Get с ошибками без отмены можно передать context.Background()
+func GetContext(ctx context.Context, id uint64, key string, description string, extra ...any) (e *Elem, data any, code int, err error) {
+	return Global().GetContext(ctx, id, key, description, extra...)
+}
+
+func (c *Cache) GetContext(ctx context.Context, id uint64, key string, description string, extra ...any) (e *Elem, data any, code int, err error) {
+	hkey, hash, check, err := c.makeHash(key, extra)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	e, data, code, _, _ = c.get(id, key, description, hkey, hash, check, &getOptions{ctx: ctx})
+
+	switch {
+	case code == CodeCanceled:
+		err = ctx.Err()
+	case e != nil && c.closed.Load():
+		err = ErrClosed
+	}
+
+	return
+}
+
+// То же, что и Get, но с готовым hash вместо вычисления его по ключу и extra - для вызывающих, которые
+// сами ведут hash своих ключей. Ключ в хранилище получается из hash так же, как при заданной HashFunc
+// (без неё 32-символьный шестнадцатеричный hash используется как есть), key сохраняется для статистики
+// и сверки при поиске. Элемент заполняется и сохраняется как обычно
+func GetByHash(id uint64, hash string, key string, description string) (e *Elem, data any, code int) {
+	return Global().GetByHash(id, hash, key, description)
+}
+
+func (c *Cache) GetByHash(id uint64, hash string, key string, description string) (e *Elem, data any, code int) {
+	e, data, code, _, _ = c.get(id, key, description, c.hashKey(hash), hash, 0, nil)
+	return
+}
+
+// hash может быть пустым, тогда он формируется из hkey, check - контрольная сумма для обнаружения коллизий (0 - нет).
+// stale - возвращены устаревшие данные.
+// background - вместе с элементом для заполнения возвращены имеющиеся данные, заполнять можно в фоне (только с opts.background)
+func (c *Cache) get(id uint64, key string, description string, hkey hashKey, hash string, check uint64, opts *getOptions) (e *Elem, data any, code int, stale bool, background bool) {
+	s := c.shard(hkey)
+	s.Lock()
+	e, data, code, stale, background = c.getLocked(s, id, key, description, hkey, hash, check, opts)
+	s.unlock()
+
+	if e != nil && !background {
+		var ok bool
+		if data, code, ok = e.loadFromBackend(id); ok {
+			e = nil
+			return
 		}
+	}
 
-		c.data[hash] = e
-		e.debug(id, "new")
+	if e != nil && !background && !e.acquireFillSlot(opts) {
+		// Не дождались разрешения на заполнение
+		e.Abort(id)
+		e, data, code = nil, nil, CodeCanceled
+	}
 
-	} else { // Уже существует
-		if e.Filled { // Заполнен
-			if now.Before(e.ExparedAt) || // Актуален
-				!e.InProgressFrom.IsZero() { // или в процессе обновления
-				// Берём что дают и уходим
-				code = e.Code
-				data = e.Data
-				e.NumberOfUses++
+	return
+}
 
-				e.debug(id, "used")
-				e = nil
-				return
-			}
+// То же, что и get, но вызывается под блокировкой части хранилища s
+func (c *Cache) getLocked(s *shard, id uint64, key string, description string, hkey hashKey, hash string, check uint64, opts *getOptions) (e *Elem, data any, code int, stale bool, background bool) {
+	if opts == nil {
+		opts = &getOptions{}
+	}
 
-			// Не актуален и не заполняется, тогда провалимся ниже будем заполнять сами
-			e.debug(id, "updating...")
-
-		} else { // Не заполнен
-			if !e.InProgressFrom.IsZero() { // В процессе заполнения
-				// Будем ждать заполнения
-				e.debug(id, "waiting...")
-				e.cond.Wait()
-				e.debug(id, "resumed")
-
-				// Дождались
-				code = e.Code
-				data = e.Data
-				e.NumberOfUses++
-				e = nil
-				return
-			}
+	var now time.Time
+	var deadline time.Time
+
+	for {
+		now = c.now()
 
-			// Не заполняется, тогда провалимся ниже будем заполнять сами
+		if c.closed.Load() {
+			// Кеш закрыт, отдаём на заполнение элемент, который нигде не хранится
+			e = s.newElem(id, key, hkey, hash, now)
+			break
 		}
+
+		var exists bool
+		e, exists = s.data[hkey]
+
+		if exists && !e.matches(key, check) {
+			// Коллизия hash - другие исходные данные. Отдаём на заполнение элемент, который нигде не хранится,
+			// чтобы не вернуть чужие данные
+			c.metrics.collisions.Add(1)
+			c.message(log.ERR, `[%d] hash collision: "%s" and "%s" have the same hash %s`, id, key, e.Key, e.Hash)
+			e = s.newElem(id, key, hkey, hash, now)
+			break
+		}
+
+		if !exists { // Не существует
+			// Создадим новый
+			e = s.add(id, key, hkey, hash, check, now)
+
+		} else { // Уже существует
+			if e.Filled { // Заполнен
+				fresh := e.fresh(now) && (opts.maxAge <= 0 || now.Sub(e.LastUpdatedAt) < opts.maxAge)
+
+				if fresh && opts.background && c.refreshAhead > 0 && e.InProgressFrom.IsZero() && !e.forever() && !e.Negative &&
+					!now.Before(e.ExparedAt.Add(-c.refreshAhead.D())) {
+					// Актуален, но скоро устареет - отдаём данные и заодно на обновление в фоне
+					code = e.Code
+					data = c.cloneData(e.Key, e.Data)
+					background = true
+					s.use(e, now)
+					c.metrics.fresh.Add(1)
+
+					e.debug(id, "refreshing ahead...")
+					break
+				}
+
+				if fresh || // Актуален
+					!e.InProgressFrom.IsZero() || // или в процессе обновления
+					e.inGrace(now) { // или обновление недавно не удалось (Grace)
+					// Берём что дают и уходим
+					code = e.Code
+					data = c.cloneData(e.Key, e.Data)
+					s.use(e, now)
+
+					if fresh {
+						c.metrics.fresh.Add(1)
+					} else {
+						stale = true
+						c.metrics.stale.Add(1)
+						s.staleHit(key)
+					}
+
+					e.debug(id, "used")
+					e = nil
+					return
+				}
+
+				// Не актуален и не заполняется, тогда провалимся ниже будем заполнять сами
+				if opts.background && c.staleWhileRevalidate && !e.Negative {
+					code = e.Code
+					data = c.cloneData(e.Key, e.Data)
+					stale = true
+					background = true
+					s.use(e, now)
+					c.metrics.stale.Add(1)
+					s.staleHit(key)
+				}
+
+				e.debug(id, "updating...")
+
+			} else { // Не заполнен
+				if !e.InProgressFrom.IsZero() { // В процессе заполнения
+					if opts.timeout > 0 {
+						if deadline.IsZero() {
+							deadline = now.Add(opts.timeout)
+						} else if !now.Before(deadline) {
+							// Не дождались
+							c.metrics.timeouts.Add(1)
+							e.debug(id, "timeout")
+							e = nil
+							code = CodeTimeout
+							return
+						}
+					}
+
+					if opts.noWait {
+						// Ждать нельзя
+						e.debug(id, "in progress")
+						e = nil
+						code = CodeInProgress
+						return
+					}
+
+					if opts.ctx != nil && opts.ctx.Err() != nil {
+						// Ожидание отменено
+						e.debug(id, "canceled")
+						e = nil
+						code = CodeCanceled
+						return
+					}
+
+					// Будем ждать заполнения
+					c.metrics.waited.Add(1)
+					e.debug(id, "waiting...")
+					e.waiters++
+					e.wait(opts.ctx, deadline)
+					e.waiters--
+					e.debug(id, "resumed")
+
+					if e.deleted {
+						// Удалён во время заполнения
+						e.debug(id, "deleted while waiting")
+						e = nil
+						code = CodeDeleted
+						return
+					}
+
+					// Проснулись - заполнено или отменено (Abort), начинаем сначала.
+					// Если заполнение было отменено, то заполнять, возможно, придётся нам
+					continue
+				}
+
+				// Не заполняется, тогда провалимся ниже будем заполнять сами
+			}
+		}
+
+		break
 	}
 
 	// Надо заполнять
-	// Вызывающий должен это понять по e != nil, сформировать данные и вызвать e.Commit()
+	// Вызывающий должен это понять по e != nil, сформировать данные и вызвать e.Commit() или e.Abort()
 
-	e.InProgressFrom = now
+	e.startFill(now)
 	e.Description = description
+	if e.check == 0 {
+		e.check = check
+	}
+	c.metrics.misses.Add(1)
 
 	return
 }
 
-//----------------------------------------------------------------------------------------------------------------------------//
+// Создание и добавление в хранилище нового элемента, вызывается под блокировкой
+func (s *shard) add(id uint64, key string, hkey hashKey, hash string, check uint64, now time.Time) (e *Elem) {
+	e = s.newElem(id, key, hkey, hash, now)
+	e.check = check
+
+	s.evict(id)
+	s.insert(e)
+	s.cache.metrics.created.Add(1)
+	e.debug(id, "new")
+	return
+}
 
-// Данные сформированы, сохраняем
-func (e *Elem) Commit(id uint64, data any, code int, lifetime config.Duration) {
-	e.cache.Lock()
-	defer e.cache.Unlock()
+func (s *shard) newElem(id uint64, key string, hkey hashKey, hash string, now time.Time) *Elem {
+	if hash == "" {
+		hash = hkey.String()
+	}
+
+	e := &Elem{
+		cond:  sync.NewCond(&s.RWMutex),
+		cache: s.cache,
+		shard: s,
+		hkey:  hkey,
+		def: def{
+			Key:       key,
+			Hash:      hash,
+			CreatedAt: now,
+			CreatedBy: id,
+		},
+	}
+
+	if s.cache.historySize > 0 {
+		e.history = newHistory(s.cache.historySize)
+	}
+
+	return e
+}
+
+// Режим Grace: последнее обновление не удалось и следующую попытку делать ещё рано, вызывается под блокировкой
+func (e *Elem) inGrace(now time.Time) bool {
+	return !e.graceRetryAt.IsZero() && now.Before(e.graceRetryAt)
+}
 
+// Завершение заполнения при Commit, вызывается под блокировкой после установки LastUpdatedAt
+func (e *Elem) finishFill() {
+	d := e.LastUpdatedAt.Sub(e.InProgressFrom)
+	if d < 0 {
+		d = 0
+	}
+
+	e.FillDuration = config.Duration(d)
 	e.InProgressFrom = time.Time{}
-	e.LastUpdatedAt = misc.NowUTC()
+	e.graceRetryAt = time.Time{}
+	e.releaseFillSlot()
+	e.cache.metrics.filled.Add(1)
+	e.cache.metrics.fillTime.Add(uint64(d))
+}
+
+// Данные для выдачи получателю: декодированные при заданном Config.Codec,
+// копия при заданном Config.Clone, иначе сами данные
+func (c *Cache) cloneData(key string, data any) any {
+	data = c.decodeData(key, data)
+
+	if c.clone == nil || data == nil {
+		return data
+	}
+
+	return c.clone(data)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Посмотреть актуальные данные без побочных эффектов: счётчики не меняются, элемент не создаётся,
+// ожидания заполнения нет. Для отсутствующих, незаполненных и устаревших элементов ok == false и code == CodeNotFound
+func Peek(key string, extra ...any) (data any, code int, ok bool) {
+	return Global().Peek(key, extra...)
+}
+
+func (c *Cache) Peek(key string, extra ...any) (data any, code int, ok bool) {
+	hkey, _, check := c.mustHash(key, extra)
+
+	s := c.shard(hkey)
+	s.RLock()
+	defer s.RUnlock()
+
+	e, exists := s.data[hkey]
+	if !exists || !e.matches(key, check) || !e.Filled || !e.fresh(c.now()) {
+		return nil, CodeNotFound, false
+	}
+
+	return c.cloneData(e.Key, e.Data), e.Code, true
+}
+
+// Проверить без побочных эффектов, отдал бы сейчас Get элемент на заполнение: элемента нет или он устарел
+// и его никто не обновляет. Если элемент заполняет или обновляет другой либо действует Grace, то false.
+// Ответ верен только на момент вызова - другой может успеть начать заполнение до последующего Get
+func ShouldFill(key string, extra ...any) bool {
+	return Global().ShouldFill(key, extra...)
+}
+
+func (c *Cache) ShouldFill(key string, extra ...any) bool {
+	hkey, _, check := c.mustHash(key, extra)
+
+	s := c.shard(hkey)
+	s.RLock()
+	defer s.RUnlock()
+
+	e, exists := s.data[hkey]
+	if !exists || !e.matches(key, check) {
+		return true
+	}
+
+	if !e.InProgressFrom.IsZero() {
+		return false
+	}
+
+	now := c.now()
+	return !e.Filled || (!e.fresh(now) && !e.inGrace(now))
+}
+
+// Оставшееся время жизни заполненного элемента, для устаревших - отрицательное.
+// ok == false - элемента нет или он не заполнен, для неустаревающих - 0 и ok == true (см. forever)
+func TTL(key string, extra ...any) (ttl time.Duration, forever bool, ok bool) {
+	return Global().TTL(key, extra...)
+}
+
+func (c *Cache) TTL(key string, extra ...any) (ttl time.Duration, forever bool, ok bool) {
+	hkey, _, check := c.mustHash(key, extra)
+
+	s := c.shard(hkey)
+	s.RLock()
+	defer s.RUnlock()
+
+	e, exists := s.data[hkey]
+	if !exists || !e.matches(key, check) || !e.Filled {
+		return
+	}
+
+	if e.forever() {
+		return 0, true, true
+	}
+
+	return e.ExparedAt.Sub(c.now()), false, true
+}
+
+// Получить данные без заполнения и ожидания: то же, что и Get, но там, где Get отдал бы элемент на заполнение
+// или стал бы ждать заполнения другим, сразу возвращает ok == false (code == CodeNotFound), ничего не создавая и не захватывая.
+// Устаревшие данные, которые в это время обновляет другой, отдаются, как и в Get (stale == true).
+// В отличие от Peek, использование учитывается в счётчиках
+func TryGet(key string, extra ...any) (data any, code int, stale bool, ok bool) {
+	return Global().TryGet(key, extra...)
+}
+
+func (c *Cache) TryGet(key string, extra ...any) (data any, code int, stale bool, ok bool) {
+	hkey, _, check := c.mustHash(key, extra)
+
+	s := c.shard(hkey)
+	s.Lock()
+	defer s.unlock()
+
+	e, exists := s.data[hkey]
+	if !exists || !e.matches(key, check) || !e.Filled {
+		return nil, CodeNotFound, false, false
+	}
+
+	now := c.now()
+	fresh := e.fresh(now)
+	if !fresh && e.InProgressFrom.IsZero() && !e.inGrace(now) {
+		return nil, CodeNotFound, false, false
+	}
+
+	s.use(e, now)
+	if fresh {
+		c.metrics.fresh.Add(1)
+	} else {
+		c.metrics.stale.Add(1)
+		s.staleHit(key)
+	}
+
+	return c.cloneData(e.Key, e.Data), e.Code, !fresh, true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Данные сформированы, сохраняем.
+// lifetime == 0 - время жизни по умолчанию (DefaultLifetime), если оно не задано или lifetime == LifetimeForever,
+// то данные не устаревают и не удаляются сборщиком мусора, пока их не удалят явно
+func (e *Elem) Commit(id uint64, data any, code int, lifetime config.Duration) error {
+	return e.CommitEx(id, data, code, lifetime, nil)
+}
+
+// То же, что и Commit, с дополнительными параметрами (nil - без них).
+// Возвращает ErrClosed, если кеш закрыт (данные сохраняются только в самом элементе), и ErrNotInProgress,
+// если элемент уже был сохранён или отменён - повторный вызов ничего не делает.
+// С opts.Token другого заполнения возвращает ErrNotOwner, элемент не меняется
+func (e *Elem) CommitEx(id uint64, data any, code int, lifetime config.Duration, opts *CommitOptions) (err error) {
+	_, err = e.commit(id, data, code, lifetime, opts)
+	return
+}
+
+// Данные сформированы, но сохраняются, только если изменились: если contentHash совпадает с переданным
+// в предыдущий раз, то в элементе остаются прежние данные и код, а время жизни продлевается, как при Commit.
+// Поле Hash для этого не подходит - это hash ключа. Пустой contentHash - всегда сохранять.
+// changed - данные заменены
+func (e *Elem) CommitIfChanged(id uint64, data any, code int, lifetime config.Duration, contentHash string) (changed bool, err error) {
+	return e.commit(id, data, code, lifetime, &CommitOptions{ContentHash: contentHash})
+}
+
+func (e *Elem) commit(id uint64, data any, code int, lifetime config.Duration, opts *CommitOptions) (changed bool, err error) {
+	e.shard.Lock()
+	defer e.shard.unlock()
+
+	return e.commitLocked(id, data, code, lifetime, opts)
+}
+
+// Сохранение данных, вызывается под блокировкой части хранилища элемента
+func (e *Elem) commitLocked(id uint64, data any, code int, lifetime config.Duration, opts *CommitOptions) (changed bool, err error) {
+	if e.InProgressFrom.IsZero() {
+		e.cache.message(log.WARNING, `[%d] "%s": commit of the element that is not in progress (already commited or aborted), ignored`, id, e.Key)
+		return false, ErrNotInProgress
+	}
+
+	if opts != nil && opts.Token != 0 && opts.Token != e.token {
+		e.cache.message(log.WARNING, `[%d] "%s": commit with the token of another fill, ignored`, id, e.Key)
+		return false, ErrNotOwner
+	}
+
+	e.finishFlight(id, true, data, code, lifetime, opts)
+
+	if e.deleted {
+		e.InProgressFrom = time.Time{}
+		e.releaseFillSlot()
+		e.debug(id, "commit of the deleted element, ignored")
+		return false, ErrDeleted
+	}
+
+	if e.cache.closed.Load() {
+		err = ErrClosed
+	}
+
+	if opts != nil && opts.ContentHash != "" && e.Filled && e.ContentHash == opts.ContentHash {
+		// Данные не изменились, только продлеваем
+		if opts.Tags != nil {
+			e.shard.setTags(e, opts.Tags)
+		}
+
+		if opts.Meta != nil {
+			e.setMeta(opts.Meta)
+		}
+
+		e.LastUpdatedAt = e.cache.now()
+		e.finishFill()
+		e.Lifetime = e.cache.lifetime(e.Key, code, lifetime, e.Negative)
+		e.ExparedAt = e.cache.expiration(e.LastUpdatedAt, e.Lifetime)
+		e.shard.use(e, e.LastUpdatedAt)
+
+		e.cond.Broadcast()
+
+		e.debug(id, "unchanged")
+		return false, err
+	}
+
+	size := int64(0)
+	negative := false
+	contentHash := ""
+	priority := 0
+	if opts != nil {
+		if opts.Tags != nil {
+			e.shard.setTags(e, opts.Tags)
+		}
+		size = opts.Size
+		negative = opts.Negative
+		contentHash = opts.ContentHash
+		priority = opts.Priority
+
+		if opts.Meta != nil {
+			e.setMeta(opts.Meta)
+		}
+	}
+
+	lifetime = e.cache.lifetime(e.Key, code, lifetime, negative)
+
+	e.LastUpdatedAt = e.cache.now()
+	e.finishFill()
 	e.Lifetime = lifetime
-	e.ExparedAt = e.LastUpdatedAt.Add(lifetime.D())
+	e.ExparedAt = e.cache.expiration(e.LastUpdatedAt, lifetime)
 	e.Filled = true
+	e.Negative = negative
 	e.Code = code
-	e.Data = data
-	e.NumberOfUpdates++
-	e.NumberOfUses++
+	e.releaseData()
+	e.Data = e.shareData(contentHash, e.cache.encodeData(e.Key, data))
+	e.ContentHash = contentHash
+	saturatedInc(&e.NumberOfUpdates)
+	e.LastUpdatedBy = id
+	e.shard.use(e, e.LastUpdatedAt)
+	e.shard.setPriority(e, priority)
+	e.shard.setSize(e, size)
 
 	e.cond.Broadcast()
+	e.shard.notifyFilled()
+
+	e.shard.addEvent(EventCommit, e)
+
+	if e.cache.onCommit != nil {
+		st := Stat{def: e.def, Cache: e.cache.name, at: e.LastUpdatedAt}
+		e.shard.hooks = append(e.shard.hooks, func() { e.cache.onCommit(st, data) })
+	}
+
+	if e.cache.backend != nil && (opts == nil || !opts.fromBackend) {
+		key, hash := e.Key, e.Hash
+		e.shard.hooks = append(e.shard.hooks, func() { e.cache.storeToBackend(id, key, hash, data, code, lifetime) })
+	}
 
-	e.debug(id, "commited")
+	if opts != nil && opts.fromBackend {
+		e.debug(id, "loaded from backend")
+	} else {
+		e.debug(id, "commited")
+	}
+	return true, err
+}
+
+// Копирование метаданных, чтобы их последующее изменение вызывающим не затрагивало элемент и уже выданную статистику.
+// Вызывается под блокировкой
+func (e *Elem) setMeta(meta map[string]string) {
+	if len(meta) == 0 {
+		e.Meta = nil
+		return
+	}
+
+	e.Meta = make(map[string]string, len(meta))
+	for k, v := range meta {
+		e.Meta[k] = v
+	}
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
-func makeHash(key string, extra ...any) (hash string) {
-	d := struct {
-		Key   string
-		Extra []any
-	}{
-		Key:   key,
-		Extra: extra,
+// Данные сформировать не удалось, освобождаем элемент.
+// Если в элементе есть старые данные, то они остаются и продолжают отдаваться,
+// если нет - элемент удаляется и ожидающие начинают заново (кто-то из них займётся заполнением сам).
+// Можно вызывать в defer - после Commit ничего не делает
+func (e *Elem) Abort(id uint64) {
+	e.shard.Lock()
+	defer e.shard.unlock()
+
+	e.abortLocked(id)
+}
+
+// Вызывается под блокировкой
+func (e *Elem) abortLocked(id uint64) {
+	if e.InProgressFrom.IsZero() {
+		// Не в процессе заполнения (уже закоммичен или отменён)
+		return
+	}
+
+	e.InProgressFrom = time.Time{}
+	e.releaseFillSlot()
+	e.cache.metrics.aborted.Add(1)
+	e.finishFlight(id, false, nil, 0, 0, nil)
+
+	if e.Filled {
+		if e.cache.grace > 0 {
+			// Продолжаем отдавать имеющиеся данные, следующая попытка обновления - через Grace
+			e.graceRetryAt = e.cache.now().Add(e.cache.grace.D())
+		}
+		e.cond.Broadcast()
+	} else {
+		e.shard.remove(e)
 	}
 
-	j, _ := jsonw.Marshal(d)
-	hash = string(misc.Sha512Hash(j))
+	e.debug(id, "aborted")
+}
+
+// Защита от паники между Get и Commit, вызывается только как defer e.Recover(id) сразу после получения e.
+// Если элемент не сохранён, то заполнение отменяется (Abort), иначе ожидающие ждали бы вечно.
+// Паника перехватывается и пишется в лог вместе со стеком, вызывающая функция при этом завершается нормально.
+// Если панику нужно передать дальше, то достаточно defer e.Abort(id)
+func (e *Elem) Recover(id uint64) {
+	r := recover()
+
+	e.Abort(id)
+
+	if r != nil {
+		e.cache.message(log.ERR, `[%d] "%s": panic while filling: %v%s%s`, id, e.Key, r, misc.EOS, panic.GetStack())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Ожидание места в ограничении MaxConcurrentFills для полученного на заполнение элемента, вызывается без блокировки.
+// Ожидание прерывается только отменой opts.ctx, тогда возвращается false
+func (e *Elem) acquireFillSlot(opts *getOptions) bool {
+	slots := e.cache.fillSlots
+	if slots == nil {
+		return true
+	}
+
+	var done <-chan struct{}
+	if opts != nil && opts.ctx != nil {
+		done = opts.ctx.Done()
+	}
+
+	select {
+	case slots <- struct{}{}:
+	case <-done:
+		return false
+	}
+
+	e.shard.Lock()
+	e.fillSlot = true
+	e.shard.Unlock()
+	return true
+}
+
+// Освобождение места в ограничении MaxConcurrentFills, вызывается под блокировкой
+func (e *Elem) releaseFillSlot() {
+	if e.fillSlot {
+		e.fillSlot = false
+		<-e.cache.fillSlots
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Ожидание окончания заполнения, вызывается под блокировкой.
+// sync.Cond не умеет ждать с таймаутом и отменой, поэтому при заданных deadline или ctx
+// будим всех ожидающих по таймеру или отмене контекста
+func (e *Elem) wait(ctx context.Context, deadline time.Time) {
+	wakeup := func() {
+		e.shard.Lock()
+		e.cond.Broadcast()
+		e.shard.Unlock()
+	}
+
+	if !deadline.IsZero() {
+		t := time.AfterFunc(deadline.Sub(e.cache.now()), wakeup)
+		defer t.Stop()
+	}
+
+	if ctx != nil {
+		stop := context.AfterFunc(ctx, wakeup)
+		defer stop()
+	}
+
+	e.cond.Wait()
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Удалить элемент. Возвращает false, если его не было.
+// Если элемент в процессе заполнения, то он всё равно удаляется, заполнение отменяется: ожидающие его заполнения
+// получают e == nil, data == nil и code == CodeDeleted, а Commit заполняющего ничего не сохраняет и возвращает ErrDeleted
+func Delete(key string, extra ...any) bool {
+	return Global().Delete(key, extra...)
+}
+
+func (c *Cache) Delete(key string, extra ...any) bool {
+	hkey, hash, check := c.mustHash(key, extra)
+	if hash == "" {
+		hash = hkey.String()
+	}
+
+	// В других экземплярах элемент может быть, даже если здесь его нет
+	defer c.publishInvalidation([]string{hash}, nil)
+
+	s := c.shard(hkey)
+	s.Lock()
+	defer s.unlock()
+
+	e, exists := s.data[hkey]
+	if !exists || !e.matches(key, check) {
+		return false
+	}
+
+	s.delete(e)
+	e.debug(0, "deleted")
+	return true
+}
+
+// Получить актуальные данные и сразу удалить элемент, чтобы их больше никто не получил (одноразовые данные).
+// Для отсутствующих, незаполненных, устаревших и находящихся в процессе заполнения элементов ok == false и code == CodeNotFound,
+// элемент при этом не создаётся и не удаляется. Удаление передаётся в OnInvalidate, как при Delete
+func Take(key string, extra ...any) (data any, code int, ok bool) {
+	return Global().Take(key, extra...)
+}
+
+func (c *Cache) Take(key string, extra ...any) (data any, code int, ok bool) {
+	hkey, _, check := c.mustHash(key, extra)
+
+	s := c.shard(hkey)
+	s.Lock()
+
+	e, exists := s.data[hkey]
+	if !exists || !e.matches(key, check) || !e.Filled || !e.InProgressFrom.IsZero() || !e.fresh(c.now()) {
+		s.unlock()
+		return nil, CodeNotFound, false
+	}
+
+	data, code, ok = c.cloneData(e.Key, e.Data), e.Code, true
+	c.metrics.fresh.Add(1)
+	if s.unlink(e) {
+		// Отпускается только ссылка на общие данные (Dedup), сами данные теперь у вызывающего
+		e.releaseData()
+	}
+	e.debug(0, "taken")
+	hash := e.Hash
+	s.unlock()
+
+	c.publishInvalidation([]string{hash}, nil)
 	return
 }
 
+// Удалить все элементы, ключи которых начинаются с prefix. Возвращает количество удалённых.
+// Требует просмотра всех элементов, находящиеся в процессе заполнения удаляются как при Delete.
+// В OnInvalidate передаются только hash удалённых здесь элементов
+func DeleteByKeyPrefix(prefix string) int {
+	return Global().DeleteByKeyPrefix(prefix)
+}
+
+func (c *Cache) DeleteByKeyPrefix(prefix string) (n int) {
+	var hashes []string
+
+	c.forEachShard(func(s *shard) {
+		for _, e := range s.data {
+			if strings.HasPrefix(e.Key, prefix) {
+				s.delete(e)
+				e.debug(0, "deleted by prefix")
+				hashes = append(hashes, e.Hash)
+				n++
+			}
+		}
+	})
+
+	c.publishInvalidation(hashes, nil)
+	return
+}
+
+// Продлить жизнь заполненного элемента на newLifetime от текущего момента без его обновления
+// (newLifetime обрабатывается как в Commit). Возвращает false, если элемента нет, он не заполнен
+// или находится в процессе заполнения
+func Touch(newLifetime config.Duration, key string, extra ...any) bool {
+	return Global().Touch(newLifetime, key, extra...)
+}
+
+func (c *Cache) Touch(newLifetime config.Duration, key string, extra ...any) bool {
+	hkey, _, check := c.mustHash(key, extra)
+
+	s := c.shard(hkey)
+	s.Lock()
+	defer s.unlock()
+
+	e, exists := s.data[hkey]
+	if !exists || !e.matches(key, check) || !e.Filled || !e.InProgressFrom.IsZero() {
+		return false
+	}
+
+	e.Lifetime = c.lifetime(e.Key, e.Code, newLifetime, e.Negative)
+	e.ExparedAt = c.expiration(c.now(), e.Lifetime)
+
+	e.debug(0, "touched")
+	return true
+}
+
+// Пометить заполненный элемент устаревшим, не удаляя его (в отличие от Delete): следующий Get отдаст его на обновление,
+// а остальные до завершения обновления получат прежние данные (stale). Возвращает false, если элемента нет,
+// он не заполнен или уже обновляется
+func Expire(key string, extra ...any) bool {
+	return Global().Expire(key, extra...)
+}
+
+func (c *Cache) Expire(key string, extra ...any) bool {
+	hkey, _, check := c.mustHash(key, extra)
+
+	s := c.shard(hkey)
+	s.Lock()
+	defer s.unlock()
+
+	e, exists := s.data[hkey]
+	if !exists || !e.matches(key, check) || !e.Filled || !e.InProgressFrom.IsZero() {
+		return false
+	}
+
+	now := c.now()
+	if e.fresh(now) {
+		e.ExparedAt = now
+	}
+
+	e.debug(0, "expired")
+	return true
+}
+
+// Удалить все элементы.
+// Заполнения находящихся в процессе элементов отменяются, как при Delete: их Commit возвращает ErrDeleted
+// и ничего не сохраняет (ни в кеше, ни в Backend), а ожидающие их заполнения получают CodeDeleted
+func Clear() {
+	Global().Clear()
+}
+
+func (c *Cache) Clear() {
+	n := 0
+	c.forEachShard(func(s *shard) {
+		n += s.clear(true)
+	})
+
+	c.message(log.DEBUG, "cleared, %d elements removed", n)
+}
+
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// Закрыть кеш: остановить сборщик мусора и удалить все элементы.
+// После закрытия кеш ничего не хранит: Get всегда возвращает элемент для заполнения,
+// который не сохраняется, а ожидающие заполнения просыпаются и получают такой же элемент
+func (c *Cache) Close() {
+	if !c.closed.CompareAndSwap(false, true) {
+		return
+	}
+
+	close(c.done)
+	c.forEachShard(func(s *shard) {
+		s.clear(false)
+		s.notifyFilled()
+	})
+	c.subscribers.closeAll()
+
+	c.message(log.INFO, "closed")
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Сообщение в журнал кеша, с именем кеша в начале, если оно задано
+func (c *Cache) message(level log.Level, message string, params ...any) {
+	if c.name != "" {
+		message = c.name + ": " + message
+	}
+
+	c.log.MessageEx(1, level, nil, message, params...)
+}
+
+// Имя кеша (Config.Name), у глобального - пустое
+func (c *Cache) Name() string {
+	return c.name
+}
+
 func (e *Elem) debug(id uint64, op string) {
-	if Log.CurrentLogLevel() >= log.DEBUG {
+	if e.history != nil {
+		e.history.add(e.cache.now(), id, op)
+	}
+
+	if e.cache.log.CurrentLogLevel() >= log.DEBUG {
 		j, _ := jsonw.Marshal(e)
-		Log.Message(log.DEBUG, "[%d] %s %s", id, op, j)
+		e.cache.message(log.DEBUG, "[%d] %s %s", id, op, j)
 	}
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// Количество элементов
+func Len() int {
+	return Global().Len()
+}
+
+func (c *Cache) Len() (n int) {
+	c.forEachShardRead(func(s *shard) {
+		n += len(s.data)
+	})
+
+	return
+}
+
+// Количество элементов в процессе заполнения. Требует полного просмотра хранилища,
+// поэтому для проверок состояния, а не для частого вызова
+func InProgressCount() int {
+	return Global().InProgressCount()
+}
+
+func (c *Cache) InProgressCount() (n int) {
+	c.forEachShardRead(func(s *shard) {
+		for _, e := range s.data {
+			if !e.InProgressFrom.IsZero() {
+				n++
+			}
+		}
+	})
+
+	return
+}
+
+// Суммарный размер данных элементов, указанный в CommitOptions.Size
+func TotalBytes() int64 {
+	return Global().TotalBytes()
+}
+
+func (c *Cache) TotalBytes() int64 {
+	return c.bytes.Load()
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
 func GetStat() (s Stats) {
-	return storage.GetStat()
+	return Global().GetStat()
 }
 
 func (c *Cache) GetStat() (s Stats) {
-	c.Lock()
-	defer c.Unlock()
+	return c.getStat(false, nil)
+}
 
-	s = make(Stats, 0, len(c.data))
+// То же, что и GetStat, но вместе с данными элементов. Без Config.Clone в Stat попадает то же значение,
+// что отдаётся из кеша, поэтому изменять его нельзя, а безопасность одновременного чтения обеспечивает вызывающий
+func GetStatWithData() (s Stats) {
+	return Global().GetStatWithData()
+}
+
+func (c *Cache) GetStatWithData() (s Stats) {
+	return c.getStat(true, nil)
+}
 
-	for _, e := range c.data {
-		s = append(s,
-			Stat{
-				def: e.def,
-			},
-		)
+// filter == nil - все элементы
+func (c *Cache) getStat(withData bool, filter StatFilter) (s Stats) {
+	if filter == nil {
+		s = make(Stats, 0, c.Len())
 	}
 
+	now := c.now()
+	c.forEachShardRead(func(sh *shard) {
+		for _, e := range sh.data {
+			st := Stat{
+				def:     e.def,
+				Cache:   c.name,
+				Waiters: e.waiters,
+				at:      now,
+			}
+			if filter != nil && !filter(&st) {
+				continue
+			}
+
+			if withData {
+				st.Data = c.cloneData(e.Key, e.Data)
+			}
+
+			s = append(s, st)
+		}
+	})
+
 	sort.Sort(s)
 	return
 }
@@ -262,12 +1469,22 @@ func (s Stats) Len() int {
 	return len(s)
 }
 
+// Порядок по умолчанию: ключ, затем описание, затем hash. hash у элементов кеша различны,
+// поэтому порядок однозначен и не меняется между вызовами
 func (s Stats) Less(i, j int) bool {
-	if s[i].Key == s[j].Key {
-		return s[i].Description < s[j].Description
+	return statLess(s[i].Key, s[i].Description, s[i].Hash, s[j].Key, s[j].Description, s[j].Hash)
+}
+
+func statLess(key1, description1, hash1, key2, description2, hash2 string) bool {
+	if key1 != key2 {
+		return key1 < key2
+	}
+
+	if description1 != description2 {
+		return description1 < description2
 	}
 
-	return s[i].Key < s[j].Key
+	return hash1 < hash2
 }
 
 func (s Stats) Swap(i, j int) {
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"sync"
+
+	"github.com/alrusov/config"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Общее заполнение нескольких ключей (GetCoalesced)
+	flight struct {
+		members []*Elem       // Элементы присоединившихся, сохраняются вместе с элементом заполняющего
+		done    chan struct{} // Закрывается по завершении
+		ok      bool          // Заполнено (Commit), иначе отменено (Abort)
+		data    any
+		code    int
+	}
+
+	flights struct {
+		mutex sync.Mutex
+		list  map[string]*flight
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// То же, что и Get, но заполнение объединяется не только по ключу хранения, но и по coalesceKey: если элемент
+// надо заполнять, а другой вызывающий уже заполняет элемент с другим ключом, но тем же coalesceKey, то вместо
+// отдачи элемента на заполнение ждём его результата. Commit заполняющего сохраняет те же данные, код, время
+// жизни и параметры во все присоединившиеся элементы (каждый под своим ключом), и они получают эти данные.
+// Если заполняющий вызвал Abort, то присоединившиеся получают на заполнение свои элементы.
+// Ожидание не ограничено по времени. Пустой coalesceKey - то же, что Get
+func GetCoalesced(id uint64, coalesceKey string, key string, description string, extra ...any) (e *Elem, data any, code int) {
+	return Global().GetCoalesced(id, coalesceKey, key, description, extra...)
+}
+
+func (c *Cache) GetCoalesced(id uint64, coalesceKey string, key string, description string, extra ...any) (e *Elem, data any, code int) {
+	e, data, code = c.Get(id, key, description, extra...)
+	if e == nil || coalesceKey == "" {
+		return
+	}
+
+	fs := &c.flights
+	fs.mutex.Lock()
+
+	f, exists := fs.list[coalesceKey]
+	if !exists {
+		// Заполнять будем мы
+		if fs.list == nil {
+			fs.list = make(map[string]*flight)
+		}
+		f = &flight{done: make(chan struct{})}
+		fs.list[coalesceKey] = f
+		fs.mutex.Unlock()
+
+		e.shard.Lock()
+		e.flight = f
+		e.flightKey = coalesceKey
+		e.shard.Unlock()
+		return
+	}
+
+	f.members = append(f.members, e)
+	fs.mutex.Unlock()
+
+	e.debug(id, "coalesced, waiting...")
+	<-f.done
+
+	if !f.ok {
+		// Заполняющий отменил, заполняем сами
+		return
+	}
+
+	return nil, c.cloneData(key, f.data), f.code
+}
+
+// Завершение общего заполнения, вызывается под блокировкой части хранилища элемента заполняющего.
+// Присоединившиеся сохраняются (ok) или освобождаются после снятия блокировки
+func (e *Elem) finishFlight(id uint64, ok bool, data any, code int, lifetime config.Duration, opts *CommitOptions) {
+	f := e.flight
+	if f == nil {
+		return
+	}
+
+	key := e.flightKey
+	e.flight = nil
+	e.flightKey = ""
+
+	c := e.cache
+	e.shard.hooks = append(e.shard.hooks, func() {
+		c.flights.mutex.Lock()
+		delete(c.flights.list, key)
+		members := f.members
+		c.flights.mutex.Unlock()
+
+		if ok {
+			if opts != nil && opts.Token != 0 {
+				// Токен относится к элементу заполняющего
+				o := *opts
+				o.Token = 0
+				opts = &o
+			}
+
+			for _, m := range members {
+				m.commit(id, data, code, lifetime, opts)
+			}
+		}
+
+		f.ok, f.data, f.code = ok, data, code
+		close(f.done)
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
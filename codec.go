@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/alrusov/log"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Кодирование (например, сжатие) хранимых данных вида []byte (Config.Codec).
+	// Данные кодируются при Commit и декодируются при каждой выдаче, поэтому экономия памяти оплачивается
+	// процессорным временем на каждом Get, причём под блокировкой части хранилища. Имеет смысл для больших
+	// и редко читаемых данных. Данные остальных типов и короче Config.CodecThreshold хранятся как есть
+	Codec interface {
+		Encode(p []byte) ([]byte, error)
+		Decode(p []byte) ([]byte, error)
+	}
+
+	// Сжатие gzip
+	GzipCodec struct {
+		Level int // Уровень сжатия (gzip.BestSpeed ... gzip.BestCompression), 0 - gzip.DefaultCompression
+	}
+
+	// Закодированные данные в Elem.Data
+	encodedData []byte
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (g GzipCodec) Encode(p []byte) ([]byte, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	var b bytes.Buffer
+	w, err := gzip.NewWriterLevel(&b, level)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = w.Write(p); err != nil {
+		return nil, err
+	}
+
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (g GzipCodec) Decode(p []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Данные для хранения: при заданном Codec []byte не короче CodecThreshold кодируются.
+// При ошибке кодирования данные хранятся как есть
+func (c *Cache) encodeData(key string, data any) any {
+	if c.codec == nil {
+		return data
+	}
+
+	p, ok := data.([]byte)
+	if !ok || len(p) < c.codecThreshold {
+		return data
+	}
+
+	enc, err := c.codec.Encode(p)
+	if err != nil {
+		c.message(log.ERR, `"%s": encode: %s`, key, err)
+		return data
+	}
+
+	return encodedData(enc)
+}
+
+// Исходные данные из хранимых. При ошибке декодирования - nil
+func (c *Cache) decodeData(key string, data any) any {
+	enc, ok := data.(encodedData)
+	if !ok {
+		return data
+	}
+
+	p, err := c.codec.Decode(enc)
+	if err != nil {
+		c.message(log.ERR, `"%s": decode: %s`, key, err)
+		return nil
+	}
+
+	return p
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
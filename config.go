@@ -0,0 +1,245 @@
+package cache
+
+import (
+	"math/rand"
+	"runtime"
+	"time"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Настройки кеша
+	Config struct {
+		Name                 string          `toml:"name"`                   // Имя кеша для статистики и журнала, пустое - без имени
+		InitialCapacity      int             `toml:"initial-capacity"`       // Начальное количество элементов, под которое заранее выделяется хранилище (всего, делится между частями), 0 - DefaultInitialCapacity
+		GCInterval           config.Duration `toml:"gc-interval"`            // Интервал между проходами сборщика мусора
+		DisableGC            bool            `toml:"disable-gc"`             // Не запускать сборщик мусора: устаревшие элементы удаляются только явно (DeleteExpired, Delete и т.п.)
+		GCRetentionFactor    float64         `toml:"gc-retention-factor"`    // Сборщик мусора удаляет элемент через столько времён жизни после обновления, 0 - DefaultGCRetentionFactor, минимум 1
+		DefaultLifetime      config.Duration `toml:"default-lifetime"`       // Время жизни, если в Commit передано 0
+		NegativeLifetime     config.Duration `toml:"negative-lifetime"`      // Время жизни отрицательного результата (CommitOptions.Negative), если в Commit передано 0, 0 - как DefaultLifetime
+		MaxLifetime          config.Duration `toml:"max-lifetime"`           // Максимальное время жизни при Commit и Touch, большие значения (и "без устаревания") ограничиваются, 0 - без ограничений
+		Grace                config.Duration `toml:"grace"`                  // Режим Grace: после неудачного обновления (Abort) устаревшие данные отдаются ещё столько времени, затем новая попытка; 0 - выключен
+		MaxEntries           int             `toml:"max-entries"`            // Максимальное количество элементов во всём кеше (при нескольких Shards порядок вытеснения приблизительный), 0 - без ограничений
+		MaxBytes             int64           `toml:"max-bytes"`              // Максимальный суммарный размер данных (CommitOptions.Size) во всём кеше, 0 - без ограничений
+		SoftEvictBytes       bool            `toml:"soft-evict-bytes"`       // При превышении MaxBytes освобождать только данные элементов (как SoftEvict), сохраняя статистику
+		EvictionPolicy       EvictionPolicy  `toml:"eviction-policy"`        // Политика вытеснения при достижении MaxEntries или MaxBytes
+		Shards               int             `toml:"shards"`                 // Количество частей хранилища со своими блокировками, 0 - GOMAXPROCS
+		StaleWhileRevalidate bool            `toml:"stale-while-revalidate"` // GetOrSet отдаёт устаревшие данные сразу, обновляя их в фоне
+		RefreshAhead         config.Duration `toml:"refresh-ahead"`          // GetOrSet обновляет данные в фоне, если до устаревания осталось меньше, 0 - не обновляет
+		MaxConcurrentFills   int             `toml:"max-concurrent-fills"`   // Максимальное количество одновременных заполнений, 0 - без ограничений
+		Dedup                bool            `toml:"dedup"`                  // Элементы с одинаковым CommitOptions.ContentHash хранят одни и те же данные (общие, изменять их нельзя)
+		HistorySize          int             `toml:"history-size"`           // Количество последних операций, запоминаемых для каждого элемента (History), 0 - не запоминаются
+		JitterFraction       float64         `toml:"jitter-fraction"`        // Доля времени жизни, на которую оно может быть случайно уменьшено при Commit, 0 - без разброса
+		JitterSource         rand.Source     `toml:"-"`                      // Источник случайных чисел для разброса, nil - инициализированный JitterSeed
+		JitterSeed           int64           `toml:"jitter-seed"`            // Начальное значение источника случайных чисел, если JitterSource не задан, 0 - текущее время. Для воспроизводимости тестов и измерений
+		HashFunc             HashFunc        `toml:"-"`                      // Функция вычисления hash, nil - FNV-1a 128 (как FNVHash, но без строки на каждый поиск)
+		Log                  *log.Facility   `toml:"-"`                      // Журнал кеша, nil - по LogName
+		LogName              string          `toml:"log-name"`               // Имя журнала кеша, если Log не задан, пустое - общий журнал пакета (Log)
+		OnEvict              EvictFunc       `toml:"-"`                      // Вызывается для удалённых из кеша заполненных элементов, nil - не вызывается
+		OnCommit             CommitFunc      `toml:"-"`                      // Вызывается после каждого Commit, nil - не вызывается
+		Backend              Backend         `toml:"-"`                      // Хранилище второго уровня: при промахе Get сначала ищет в нём, Commit записывает в него, nil - нет
+		OnInvalidate         InvalidateFunc  `toml:"-"`                      // Вызывается при явном удалении элементов (Delete, DeleteByKeyPrefix, InvalidateTag), nil - не вызывается
+		OnStaleHit           StaleHitFunc    `toml:"-"`                      // Вызывается, когда Get отдаёт устаревшие данные, nil - не вызывается
+		Clone                CloneFunc       `toml:"-"`                      // Копирование отдаваемых данных, nil - отдаются сами хранимые данные
+		Codec                Codec           `toml:"-"`                      // Кодирование (например, сжатие, GzipCodec) хранимых данных вида []byte, nil - хранятся как есть
+		CodecThreshold       int             `toml:"codec-threshold"`        // Минимальный размер кодируемых Codec данных
+		LifetimePolicy       LifetimePolicy  `toml:"-"`                      // Время жизни по коду, если в Commit передано 0, nil - не используется
+	}
+
+	// Политика вытеснения
+	EvictionPolicy string
+
+	// Обработчик удаления элемента из кеша (вытеснение, сборщик мусора, Delete, Clear и т.п.).
+	// Вызывается после снятия блокировки, поэтому может обращаться к кешу.
+	// Для элементов одной части хранилища вызывается в порядке удаления, но разные части могут вызывать его одновременно
+	EvictFunc func(key string, data any)
+
+	// Обработчик явного удаления элементов для передачи другим экземплярам (например, через брокер сообщений),
+	// которые применяют его через ApplyInvalidation. hashes - Elem.Hash удалённых элементов, tags - удалённые теги.
+	// Вызывается без блокировок кеша. Clear, сборщик мусора, вытеснение и ApplyInvalidation его не вызывают
+	InvalidateFunc func(hashes []string, tags []string)
+
+	// Обработчик сохранения данных элемента. Получает состояние элемента на момент Commit.
+	// Как и EvictFunc, вызывается после снятия блокировки
+	CommitFunc func(st Stat, data any)
+
+	// Обработчик выдачи устаревших данных (элемент уже обновляется другим или включён StaleWhileRevalidate),
+	// например, чтобы самостоятельно запустить обновление. Как и EvictFunc, вызывается после снятия блокировки
+	StaleHitFunc func(key string)
+
+	// Копирование данных при выдаче из кеша (Get и его варианты, TryGet, Peek, Take, BatchGet, GetStatWithData, ForEach).
+	// Без него все получатели разделяют один и тот же хранимый объект: изменение полученных срезов, отображений
+	// или данных по указателю портит кеш для остальных и приводит к гонкам. Должно возвращать глубокую копию.
+	// Может вызываться под блокировкой части хранилища, поэтому не должно обращаться к кешу
+	CloneFunc func(data any) any
+
+	// Время жизни данных по их коду, например, короткое для ошибок. Используется, если в Commit передано 0,
+	// возврат 0 - код не обрабатывается, время жизни выбирается как обычно. Вызывается под блокировкой
+	LifetimePolicy func(code int) config.Duration
+
+	// Конфигурация приложения, содержащая настройки кеша
+	AppConfig interface {
+		CacheConfig() *Config
+	}
+)
+
+const (
+	EvictionLRU EvictionPolicy = "lru" // Давно не использовавшиеся
+	EvictionLFU EvictionPolicy = "lfu" // Реже всего использовавшиеся
+)
+
+const (
+	DefaultInitialCapacity   = 128
+	DefaultGCInterval        = config.Duration(60 * time.Second)
+	DefaultGCRetentionFactor = 2.0
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Check --
+func (x *Config) Check(cfg any) (err error) {
+	msgs := misc.NewMessages()
+
+	if x.InitialCapacity < 0 {
+		msgs.Add("cache.initial-capacity: negative value %d", x.InitialCapacity)
+	}
+
+	if x.GCInterval < 0 {
+		msgs.Add("cache.gc-interval: negative value %s", x.GCInterval.D())
+	}
+
+	if x.GCRetentionFactor != 0 && x.GCRetentionFactor < 1 {
+		msgs.Add("cache.gc-retention-factor: %g is less than 1", x.GCRetentionFactor)
+	}
+
+	if x.DefaultLifetime < 0 {
+		msgs.Add("cache.default-lifetime: negative value %s", x.DefaultLifetime.D())
+	}
+
+	if x.MaxLifetime < 0 {
+		msgs.Add("cache.max-lifetime: negative value %s", x.MaxLifetime.D())
+	}
+
+	if x.NegativeLifetime < 0 {
+		msgs.Add("cache.negative-lifetime: negative value %s", x.NegativeLifetime.D())
+	}
+
+	if x.Grace < 0 {
+		msgs.Add("cache.grace: negative value %s", x.Grace.D())
+	}
+
+	if x.MaxEntries < 0 {
+		msgs.Add("cache.max-entries: negative value %d", x.MaxEntries)
+	}
+
+	if x.MaxBytes < 0 {
+		msgs.Add("cache.max-bytes: negative value %d", x.MaxBytes)
+	}
+
+	if x.RefreshAhead < 0 {
+		msgs.Add("cache.refresh-ahead: negative value %s", x.RefreshAhead.D())
+	}
+
+	if x.JitterFraction < 0 || x.JitterFraction >= 1 {
+		msgs.Add("cache.jitter-fraction: %g is out of range [0, 1)", x.JitterFraction)
+	}
+
+	if x.MaxConcurrentFills < 0 {
+		msgs.Add("cache.max-concurrent-fills: negative value %d", x.MaxConcurrentFills)
+	}
+
+	if x.HistorySize < 0 {
+		msgs.Add("cache.history-size: negative value %d", x.HistorySize)
+	}
+
+	if x.CodecThreshold < 0 {
+		msgs.Add("cache.codec-threshold: negative value %d", x.CodecThreshold)
+	}
+
+	if x.Shards < 0 {
+		msgs.Add("cache.shards: negative value %d", x.Shards)
+	}
+
+	switch x.EvictionPolicy {
+	case "", EvictionLRU, EvictionLFU:
+	default:
+		msgs.Add(`cache.eviction-policy: unknown value "%s"`, x.EvictionPolicy)
+	}
+
+	x.setDefaults()
+
+	return msgs.Error()
+}
+
+// Значения по умолчанию для незаданных полей
+func (x *Config) setDefaults() {
+	if x.InitialCapacity <= 0 {
+		x.InitialCapacity = DefaultInitialCapacity
+	}
+
+	if x.GCInterval <= 0 {
+		x.GCInterval = DefaultGCInterval
+	}
+
+	if x.GCRetentionFactor == 0 {
+		x.GCRetentionFactor = DefaultGCRetentionFactor
+	} else if x.GCRetentionFactor < 1 {
+		x.GCRetentionFactor = 1
+	}
+
+	if x.DefaultLifetime < 0 {
+		x.DefaultLifetime = 0
+	}
+
+	if x.NegativeLifetime < 0 {
+		x.NegativeLifetime = 0
+	}
+
+	if x.MaxLifetime < 0 {
+		x.MaxLifetime = 0
+	}
+
+	if x.Grace < 0 {
+		x.Grace = 0
+	}
+
+	if x.MaxEntries < 0 {
+		x.MaxEntries = 0
+	}
+
+	if x.MaxBytes < 0 {
+		x.MaxBytes = 0
+	}
+
+	if x.EvictionPolicy != EvictionLFU {
+		x.EvictionPolicy = EvictionLRU
+	}
+
+	if x.Shards <= 0 {
+		x.Shards = runtime.GOMAXPROCS(0)
+	}
+
+	if x.RefreshAhead < 0 {
+		x.RefreshAhead = 0
+	}
+
+	if x.HistorySize < 0 {
+		x.HistorySize = 0
+	}
+
+	if x.JitterFraction < 0 || x.JitterFraction >= 1 {
+		x.JitterFraction = 0
+	}
+
+	// Источник создаёт NewWithConfig: после Check (setDefaults) он должен отличать свой источник от заданного вызывающим
+	if x.JitterSource == nil && x.JitterSeed == 0 {
+		x.JitterSeed = time.Now().UnixNano()
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,61 @@
+package cache
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Общие данные элементов с одинаковым ContentHash
+	dedupData struct {
+		data any
+		refs int // Количество элементов, использующих data
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Данные для сохранения в элементе при Commit, вызывается под блокировкой части хранилища.
+// В режиме Dedup при наличии в кеше элемента с тем же contentHash возвращаются его данные, чтобы не хранить копии
+func (e *Elem) shareData(contentHash string, data any) any {
+	c := e.cache
+	if c.dedup == nil || contentHash == "" || e.shard.data[e.hkey] != e {
+		// Без Dedup, без hash содержимого или элемент не хранится (удалён, коллизия, кеш закрыт)
+		return data
+	}
+
+	c.dedupMutex.Lock()
+	defer c.dedupMutex.Unlock()
+
+	d, exists := c.dedup[contentHash]
+	if !exists {
+		d = &dedupData{data: data}
+		c.dedup[contentHash] = d
+	}
+
+	d.refs++
+	e.dedup = true
+	return d.data
+}
+
+// Освобождение общих данных элемента, вызывается под блокировкой части хранилища перед заменой или удалением данных
+func (e *Elem) releaseData() {
+	if !e.dedup {
+		return
+	}
+
+	c := e.cache
+	e.dedup = false
+
+	c.dedupMutex.Lock()
+	defer c.dedupMutex.Unlock()
+
+	d, exists := c.dedup[e.ContentHash]
+	if !exists {
+		return
+	}
+
+	d.refs--
+	if d.refs <= 0 {
+		delete(c.dedup, e.ContentHash)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
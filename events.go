@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Вид события
+	EventOp string
+
+	// Событие для подписчиков (Subscribe)
+	Event struct {
+		Op   EventOp   `json:"op"`
+		Key  string    `json:"key"`
+		Hash string    `json:"hash"`
+		Code int       `json:"code"`
+		At   time.Time `json:"at"`
+	}
+
+	// Подписчики кеша
+	subscribers struct {
+		mutex   sync.RWMutex
+		list    map[uint64]chan Event
+		lastID  uint64
+		count   atomic.Int32  // Количество подписчиков, чтобы без них не формировать события
+		dropped atomic.Uint64 // Не доставлено событий из-за переполнения канала подписчика
+	}
+)
+
+const (
+	EventCommit EventOp = "commit" // Данные сохранены (как OnCommit)
+	EventEvict  EventOp = "evict"  // Данные удалены из кеша (как OnEvict)
+
+	// Размер буфера канала подписчика
+	SubscribeBuffer = 256
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Подписка на события сохранения и удаления данных - то же, что OnCommit и OnEvict, но для любого количества получателей.
+// События отправляются без ожидания: если буфер канала подписчика (SubscribeBuffer) заполнен, событие теряется,
+// поэтому медленный подписчик не задерживает кеш. Канал закрывается вызовом cancel или при закрытии кеша (Close)
+func Subscribe() (events <-chan Event, cancel func()) {
+	return Global().Subscribe()
+}
+
+func (c *Cache) Subscribe() (events <-chan Event, cancel func()) {
+	ss := &c.subscribers
+	ch := make(chan Event, SubscribeBuffer)
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if ss.list == nil {
+		ss.list = make(map[uint64]chan Event)
+	}
+
+	ss.lastID++
+	id := ss.lastID
+
+	if c.closed.Load() {
+		close(ch)
+		return ch, func() {}
+	}
+
+	ss.list[id] = ch
+	ss.count.Add(1)
+
+	return ch, func() { ss.remove(id) }
+}
+
+// Количество событий, потерянных из-за переполнения каналов подписчиков
+func (c *Cache) DroppedEvents() uint64 {
+	return c.subscribers.dropped.Load()
+}
+
+func (ss *subscribers) remove(id uint64) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ch, exists := ss.list[id]
+	if !exists {
+		return
+	}
+
+	delete(ss.list, id)
+	ss.count.Add(-1)
+	close(ch)
+}
+
+// Отписка всех, вызывается при закрытии кеша
+func (ss *subscribers) closeAll() {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	for id, ch := range ss.list {
+		delete(ss.list, id)
+		close(ch)
+	}
+	ss.count.Store(0)
+}
+
+func (ss *subscribers) publish(ev Event) {
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+
+	for _, ch := range ss.list {
+		select {
+		case ch <- ev:
+		default:
+			ss.dropped.Add(1)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Запоминание события для подписчиков, вызывается под блокировкой - отправляется после её снятия
+func (s *shard) addEvent(op EventOp, e *Elem) {
+	ss := &s.cache.subscribers
+	if ss.count.Load() == 0 {
+		return
+	}
+
+	ev := Event{
+		Op:   op,
+		Key:  e.Key,
+		Hash: e.Hash,
+		Code: e.Code,
+		At:   s.cache.now(),
+	}
+
+	s.hooks = append(s.hooks, func() { ss.publish(ev) })
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,241 @@
+package cache
+
+import (
+	"time"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Отметка об использовании элемента, вызывается под блокировкой
+func (s *shard) use(e *Elem, now time.Time) {
+	saturatedInc(&e.NumberOfUses)
+	e.LastUsedAt = now
+
+	if e.lru != nil {
+		s.lru.MoveToFront(e.lru)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Освобождение места под новый элемент при ограниченном количестве элементов, вызывается под блокировкой.
+// Вытесняются элементы согласно политике вытеснения, находящиеся в процессе заполнения не трогаются.
+// Приоритет (CommitOptions.Priority) важнее политики: она выбирает только среди элементов с наименьшим приоритетом.
+// Ограничение общее для всего кеша: сначала вытесняются элементы этой части, а если в ней вытеснять нечего -
+// элементы других частей после снятия блокировки (evictGlobal). Поэтому при нескольких частях порядок вытеснения
+// приблизительный. Если вытеснять нечего, то ограничение временно превышается
+func (s *shard) evict(id uint64) {
+	c := s.cache
+	if c.maxEntries <= 0 {
+		return
+	}
+
+	for c.entries.Load() >= int64(c.maxEntries) {
+		if !s.evictOne(id, false, nil) {
+			s.hooks = append(s.hooks, func() { c.evictGlobal(id, nil) })
+			return
+		}
+	}
+}
+
+// Вытеснение элементов при превышении суммарного размера данных, вызывается под блокировкой.
+// keep (только что сохранённый) не вытесняется, если помещается сам, иначе вытесняется и он.
+// При SoftEvictBytes элементы не удаляются, а только освобождают данные (как SoftEvict)
+func (s *shard) evictBytes(id uint64, keep *Elem) {
+	c := s.cache
+	if c.maxBytes <= 0 {
+		return
+	}
+
+	if keep != nil && keep.Size > c.maxBytes {
+		keep = nil
+	}
+
+	for c.bytes.Load() > c.maxBytes {
+		if !s.evictOne(id, c.softEvictBytes, keep) {
+			s.hooks = append(s.hooks, func() { c.evictGlobal(id, keep) })
+			return
+		}
+	}
+}
+
+// Вытеснение из всех частей по очереди, пока превышены общие ограничения, вызывается без блокировки.
+// Блокировки частей захватываются по одной, каждый проход начинается со следующей части
+func (c *Cache) evictGlobal(id uint64, keep *Elem) {
+	n := uint64(len(c.shards))
+
+	for {
+		evicted := false
+		start := c.evictCursor.Add(1)
+
+		for i := uint64(0); i < n; i++ {
+			s := c.shards[(start+i)%n]
+			s.Lock()
+
+			overEntries := c.maxEntries > 0 && c.entries.Load() > int64(c.maxEntries)
+			overBytes := c.maxBytes > 0 && c.bytes.Load() > c.maxBytes
+			if !overEntries && !overBytes {
+				s.unlock()
+				return
+			}
+
+			if overEntries && s.evictOne(id, false, keep) {
+				evicted = true
+			}
+			if overBytes && s.evictOne(id, c.softEvictBytes, keep) {
+				evicted = true
+			}
+
+			s.unlock()
+		}
+
+		if !evicted {
+			// Вытеснять нечего, ограничение временно превышается
+			return
+		}
+	}
+}
+
+// Вытеснение одного элемента согласно политике, при soft - только данных элемента (среди имеющих размер).
+// skip не вытесняется. Возвращает false, если вытеснять нечего
+func (s *shard) evictOne(id uint64, soft bool, skip *Elem) bool {
+	var e *Elem
+	switch s.cache.evictionPolicy {
+	case EvictionLFU:
+		e = s.lfuVictim(soft, skip)
+	default:
+		e = s.lruVictim(soft, skip)
+	}
+
+	if e == nil {
+		return false
+	}
+
+	if soft {
+		s.softEvict(e)
+		e.debug(id, "soft evicted")
+		return true
+	}
+
+	s.remove(e)
+	e.debug(id, "evicted")
+	return true
+}
+
+// Установка размера данных элемента с учётом в сумме, вызывается под блокировкой.
+// Для элемента, уже удалённого из хранилища, сумма не меняется
+func (s *shard) setSize(e *Elem, size int64) {
+	if s.data[e.hkey] == e {
+		s.addBytes(size - e.Size)
+	}
+	e.Size = size
+
+	s.evictBytes(0, e)
+}
+
+// Изменение суммарного размера данных части и всего кеша, вызывается под блокировкой
+func (s *shard) addBytes(d int64) {
+	s.bytes += d
+	s.cache.bytes.Add(d)
+}
+
+// Давно не использовавшийся элемент с наименьшим приоритетом, не находящийся в процессе заполнения,
+// при sized - только заполненный и с ненулевым размером.
+// Пока приоритеты не заданы, берётся первый подходящий с конца, иначе требуется полный просмотр
+func (s *shard) lruVictim(sized bool, skip *Elem) (victim *Elem) {
+	for le := s.lru.Back(); le != nil; le = le.Prev() {
+		e := le.Value.(*Elem)
+		if e == skip || !e.InProgressFrom.IsZero() || (sized && (!e.Filled || e.Size == 0)) {
+			continue
+		}
+
+		if s.prioritized == 0 {
+			return e
+		}
+
+		if victim == nil || e.Priority < victim.Priority {
+			victim = e
+		}
+	}
+
+	return
+}
+
+// Реже всего использовавшийся элемент с наименьшим приоритетом, не находящийся в процессе заполнения,
+// при sized - только заполненный и с ненулевым размером.
+// При равном количестве использований выбирается созданный раньше.
+// Требует полного просмотра хранилища
+func (s *shard) lfuVictim(sized bool, skip *Elem) (victim *Elem) {
+	for _, e := range s.data {
+		if e == skip || !e.InProgressFrom.IsZero() || (sized && (!e.Filled || e.Size == 0)) {
+			continue
+		}
+
+		if victim == nil ||
+			e.Priority < victim.Priority ||
+			(e.Priority == victim.Priority &&
+				(e.NumberOfUses < victim.NumberOfUses ||
+					(e.NumberOfUses == victim.NumberOfUses && e.CreatedAt.Before(victim.CreatedAt)))) {
+			victim = e
+		}
+	}
+
+	return
+}
+
+// Установка приоритета элемента с учётом в счётчике части, вызывается под блокировкой
+func (s *shard) setPriority(e *Elem, priority int) {
+	if s.data[e.hkey] == e {
+		if e.Priority != 0 {
+			s.prioritized--
+		}
+		if priority != 0 {
+			s.prioritized++
+		}
+	}
+
+	e.Priority = priority
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Освободить данные элемента, сохранив его статистику, например, для больших данных при нехватке памяти.
+// Элемент становится незаполненным и следующий Get отдаст его на заполнение. Время устаревания сохраняется,
+// поэтому сборщик мусора удаляет такой элемент тогда же, когда удалил бы заполненный.
+// Возвращает false, если элемента нет, он не заполнен или находится в процессе заполнения.
+// Для освобождённых данных вызывается OnEvict
+func SoftEvict(key string, extra ...any) bool {
+	return Global().SoftEvict(key, extra...)
+}
+
+func (c *Cache) SoftEvict(key string, extra ...any) bool {
+	hkey, _, check := c.mustHash(key, extra)
+
+	s := c.shard(hkey)
+	s.Lock()
+	defer s.unlock()
+
+	e, exists := s.data[hkey]
+	if !exists || !e.matches(key, check) || !e.Filled || !e.InProgressFrom.IsZero() {
+		return false
+	}
+
+	s.softEvict(e)
+	e.debug(0, "soft evicted")
+	return true
+}
+
+// Освобождение данных элемента, вызывается под блокировкой
+func (s *shard) softEvict(e *Elem) {
+	s.addEvicted(e)
+	e.releaseData()
+
+	s.addBytes(-e.Size)
+	e.Size = 0
+	e.Filled = false
+	e.Data = nil
+	e.ContentHash = ""
+	e.graceRetryAt = time.Time{}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+	"github.com/alrusov/panic"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Формирование данных для GetOrSet
+	FillFunc func() (data any, code int, lifetime config.Duration, err error)
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Получить данные, при необходимости сформировав их через fill.
+// При успешном fill данные сохраняются (Commit), при ошибке или панике в fill заполнение отменяется (Abort),
+// ошибка возвращается вызывающему, паника пробрасывается дальше. Ошибка Commit (ErrDeleted, ErrClosed и т.п.)
+// тоже возвращается, сформированные данные при этом отдаются.
+// В режиме StaleWhileRevalidate при наличии устаревших данных они возвращаются сразу, а fill выполняется в фоне.
+// При заданном RefreshAhead, если до устаревания осталось меньше, актуальные данные возвращаются, а fill выполняется в фоне.
+// Фоновое обновление для ключа всегда одно - остальные в это время получают устаревшие данные, как и без этого режима;
+// ошибка фонового fill только пишется в лог, паника обрабатывается как в остальных горутинах приложения.
+// При заданном MaxConcurrentFills фоновое заполнение ждёт свободного места в фоне
+func GetOrSet(id uint64, key string, description string, fill FillFunc, extra ...any) (data any, code int, err error) {
+	return Global().GetOrSet(id, key, description, fill, extra...)
+}
+
+func (c *Cache) GetOrSet(id uint64, key string, description string, fill FillFunc, extra ...any) (data any, code int, err error) {
+	hkey, hash, check := c.mustHash(key, extra)
+
+	e, data, code, _, background := c.get(id, key, description, hkey, hash, check, &getOptions{background: true})
+	if e == nil {
+		return
+	}
+
+	if background {
+		go e.backgroundFill(id, fill)
+		return
+	}
+
+	return e.fill(id, fill)
+}
+
+// Заполнение элемента в фоне
+func (e *Elem) backgroundFill(id uint64, fill FillFunc) {
+	panicID := panic.ID()
+	defer panic.SaveStackToLogEx(panicID)
+
+	e.acquireFillSlot(nil)
+
+	_, _, err := e.fill(id, fill)
+	if err != nil {
+		e.cache.message(log.ERR, "[%d] background fill of %s: %s", id, e.Key, err)
+	}
+}
+
+// Заполнение элемента через fill с гарантированным Commit или Abort, возвращается и ошибка Commit
+func (e *Elem) fill(id uint64, fill FillFunc) (data any, code int, err error) {
+	committed := false
+	defer func() {
+		if !committed {
+			e.Abort(id)
+		}
+	}()
+
+	data, code, lifetime, err := fill()
+	if err != nil {
+		return
+	}
+
+	err = e.Commit(id, data, code, lifetime)
+	committed = true
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -8,10 +8,10 @@ require (
 	github.com/alrusov/jsonw v0.1.3
 	github.com/alrusov/log v0.1.39
 	github.com/alrusov/misc v1.1.15
+	github.com/alrusov/panic v0.1.15
 )
 
 require (
-	github.com/alrusov/panic v0.1.15 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
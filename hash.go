@@ -0,0 +1,230 @@
+package cache
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc64"
+	"hash/fnv"
+
+	"github.com/alrusov/jsonw"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Функция вычисления hash элемента по ключу и дополнительным параметрам
+	HashFunc func(key string, extra ...any) string
+
+	// Ключ в хранилище. Фиксированный массив, чтобы при поиске не создавать строки
+	hashKey [16]byte
+)
+
+var (
+	crcTable = crc64.MakeTable(crc64.ECMA)
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Ключ в хранилище, строковый hash и контрольная сумма для обнаружения коллизий. Без HashFunc строковый hash
+// не вычисляется (пустой) - при необходимости он получается из ключа. С HashFunc исходные данные для hash
+// не формируются, поэтому контрольной суммы нет (0) и при поиске сверяется только ключ.
+// Ошибка возможна только без HashFunc, если extra не сериализуется в JSON
+func (c *Cache) makeHash(key string, extra []any) (hkey hashKey, hash string, check uint64, err error) {
+	if c.hashFunc == nil {
+		j, err := hashInput(key, extra)
+		return fnvKey(j), "", checksum(j), err
+	}
+
+	hash = c.hashFunc(key, extra...)
+	return c.hashKey(hash), hash, 0, nil
+}
+
+// То же, что и makeHash, для вызывающих без возврата ошибки - ошибка только пишется в лог
+func (c *Cache) mustHash(key string, extra []any) (hkey hashKey, hash string, check uint64) {
+	hkey, hash, check, err := c.makeHash(key, extra)
+	if err != nil {
+		c.message(log.ERR, `"%s": %s`, key, err)
+	}
+
+	return
+}
+
+// Контрольная сумма исходных данных, алгоритм отличается от hash, поэтому их совпадение одновременно
+// практически невозможно. Никогда не равна 0 (0 - контрольной суммы нет)
+func checksum(p []byte) uint64 {
+	return crc64.Checksum(p, crcTable) | 1
+}
+
+// Элемент соответствует искомому: ключ совпадает и контрольные суммы совпадают, если они есть у обоих
+func (e *Elem) matches(key string, check uint64) bool {
+	return e.Key == key && (e.check == 0 || check == 0 || e.check == check)
+}
+
+// Ключ в хранилище по строковому hash
+func (c *Cache) hashKey(hash string) (hkey hashKey) {
+	if c.hashFunc == nil && len(hash) == 2*len(hkey) {
+		if _, err := hex.Decode(hkey[:], []byte(hash)); err == nil {
+			return
+		}
+	}
+
+	return fnvKey([]byte(hash))
+}
+
+func fnvKey(p []byte) (hkey hashKey) {
+	h := fnv.New128a()
+	h.Write(p)
+	h.Sum(hkey[:0])
+	return
+}
+
+func (hkey hashKey) String() string {
+	return hex.EncodeToString(hkey[:])
+}
+
+// Исходные данные для hash. Вместе со значениями extra учитываются их типы, поэтому значения разных типов
+// с одинаковым JSON (1 и 1.0, nil и пустой срез, структура и map) дают разный hash.
+// При ошибке сериализации extra возвращаются данные, построенные из его текстового представления,
+// чтобы вызывающие без возврата ошибки продолжали работать
+func hashInput(key string, extra []any) ([]byte, error) {
+	if j, ok := fastHashInput(key, extra); ok {
+		return j, nil
+	}
+
+	type typed struct {
+		T string
+		V any
+	}
+
+	d := struct {
+		Key   string
+		Extra []typed
+	}{
+		Key:   key,
+		Extra: make([]typed, len(extra)),
+	}
+
+	for i, v := range extra {
+		d.Extra[i] = typed{T: typeTag(v), V: v}
+	}
+
+	j, err := jsonw.Marshal(d)
+	if err != nil {
+		return fmt.Appendf(nil, "%#v", d), fmt.Errorf("%w: %w", ErrHash, err)
+	}
+
+	return j, nil
+}
+
+// Исходные данные для hash без JSON для случая, когда extra содержит только строки, целые и bool.
+// Начинается с 0, поэтому никогда не совпадает с JSON, каждое значение предваряется типом, строки - длиной
+func fastHashInput(key string, extra []any) (j []byte, ok bool) {
+	n := 1 + binary.MaxVarintLen64 + len(key)
+	for _, v := range extra {
+		s, isString := v.(string)
+		n += 1 + binary.MaxVarintLen64 + len(s)
+		if !isString {
+			switch v.(type) {
+			case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, bool:
+			default:
+				return nil, false
+			}
+		}
+	}
+
+	j = make([]byte, 0, n)
+	j = append(j, 0)
+	j = binary.AppendUvarint(j, uint64(len(key)))
+	j = append(j, key...)
+
+	for _, v := range extra {
+		switch v := v.(type) {
+		case string:
+			j = append(j, 's')
+			j = binary.AppendUvarint(j, uint64(len(v)))
+			j = append(j, v...)
+		case int:
+			j = append(j, 'i')
+			j = binary.AppendVarint(j, int64(v))
+		case int8:
+			j = append(j, 'i')
+			j = binary.AppendVarint(j, int64(v))
+		case int16:
+			j = append(j, 'i')
+			j = binary.AppendVarint(j, int64(v))
+		case int32:
+			j = append(j, 'i')
+			j = binary.AppendVarint(j, int64(v))
+		case int64:
+			j = append(j, 'i')
+			j = binary.AppendVarint(j, v)
+		case uint:
+			j = append(j, 'u')
+			j = binary.AppendUvarint(j, uint64(v))
+		case uint8:
+			j = append(j, 'u')
+			j = binary.AppendUvarint(j, uint64(v))
+		case uint16:
+			j = append(j, 'u')
+			j = binary.AppendUvarint(j, uint64(v))
+		case uint32:
+			j = append(j, 'u')
+			j = binary.AppendUvarint(j, uint64(v))
+		case uint64:
+			j = append(j, 'u')
+			j = binary.AppendUvarint(j, v)
+		case bool:
+			if v {
+				j = append(j, 't')
+			} else {
+				j = append(j, 'f')
+			}
+		}
+	}
+
+	return j, true
+}
+
+// Тип значения extra для hash. Целые со знаком и без знака объединяются так же, как в fastHashInput,
+// чтобы hash не зависел от того, какой путь вычисления выбран
+func typeTag(v any) string {
+	switch v.(type) {
+	case string:
+		return "s"
+	case int, int8, int16, int32, int64:
+		return "i"
+	case uint, uint8, uint16, uint32, uint64:
+		return "u"
+	case bool:
+		return "b"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// FNV-1a 128, совпадает с hash, используемым по умолчанию
+func FNVHash(key string, extra ...any) string {
+	return fnvKey(hashInputLogged(key, extra)).String()
+}
+
+// SHA-512, криптостойкий, но заметно медленнее
+func Sha512Hash(key string, extra ...any) string {
+	return string(misc.Sha512Hash(hashInputLogged(key, extra)))
+}
+
+// hashInput для HashFunc, которые не могут вернуть ошибку - ошибка только пишется в лог
+func hashInputLogged(key string, extra []any) []byte {
+	j, err := hashInput(key, extra)
+	if err != nil {
+		Log.Message(log.ERR, `"%s": %s`, key, err)
+	}
+
+	return j
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Операция с элементом (Config.HistorySize)
+	HistoryEvent struct {
+		At time.Time `json:"at"` // Время
+		ID uint64    `json:"id"` // id вызывающего
+		Op string    `json:"op"` // Операция (new, used, waiting..., commited, evicted и т.д.)
+	}
+
+	// Кольцевой буфер последних операций элемента. Операции записываются и под блокировкой части хранилища,
+	// и без неё, поэтому у буфера своя блокировка
+	history struct {
+		mutex  sync.Mutex
+		events []HistoryEvent
+		next   int  // Место для следующей записи
+		full   bool // Буфер заполнен, самая старая запись - next
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func newHistory(size int) *history {
+	return &history{
+		events: make([]HistoryEvent, size),
+	}
+}
+
+// Запись операции
+func (h *history) add(at time.Time, id uint64, op string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.events[h.next] = HistoryEvent{At: at, ID: id, Op: op}
+	h.next++
+	if h.next == len(h.events) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// Копия записей от старых к новым
+func (h *history) list() []HistoryEvent {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.full {
+		return append([]HistoryEvent(nil), h.events[:h.next]...)
+	}
+
+	list := make([]HistoryEvent, 0, len(h.events))
+	list = append(list, h.events[h.next:]...)
+	return append(list, h.events[:h.next]...)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Последние операции с элементом от старых к новым, не более Config.HistorySize.
+// ok == false - элемента нет или история не ведётся (HistorySize == 0)
+func History(key string, extra ...any) (events []HistoryEvent, ok bool) {
+	return Global().History(key, extra...)
+}
+
+func (c *Cache) History(key string, extra ...any) (events []HistoryEvent, ok bool) {
+	hkey, _, check := c.mustHash(key, extra)
+
+	s := c.shard(hkey)
+	s.RLock()
+	defer s.RUnlock()
+
+	e, exists := s.data[hkey]
+	if !exists || !e.matches(key, check) || e.history == nil {
+		return
+	}
+
+	return e.history.list(), true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,171 @@
+// HTTP обработчик для выдачи статистики кеша.
+// Вынесен в отдельный пакет, чтобы не тянуть net/http в основной пакет
+package httphandler
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/alrusov/jsonw"
+	"github.com/alrusov/log"
+
+	"github.com/alrusov/cache"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Реализация http.Handler для *cache.Cache.
+	// Параметры запроса (при недопустимых значениях - 400 Bad Request):
+	//   sort=<cache.SortField> - поле сортировки, по умолчанию по ключу
+	//   desc=1                 - сортировка по убыванию (значения флагов - как в strconv.ParseBool)
+	//   prefix=<строка>        - только элементы с ключом, начинающимся с prefix
+	//   expired=1              - только заполненные, но устаревшие элементы
+	//   inProgress=1           - только элементы в процессе заполнения
+	//   format=html            - простая HTML таблица вместо JSON (format=json - по умолчанию)
+	Handler struct {
+		cache *cache.Cache
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Новый обработчик для кеша c (nil - глобальный)
+func New(c *cache.Cache) *Handler {
+	if c == nil {
+		c = cache.Global()
+	}
+
+	return &Handler{
+		cache: c,
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+
+	desc, err := flag(q, "desc")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	expired, err := flag(q, "expired")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	inProgress, err := flag(q, "inProgress")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	by := cache.SortField(q.Get("sort"))
+	if by == "" {
+		by = cache.SortByKey
+	} else if !by.Valid() {
+		http.Error(w, fmt.Sprintf(`unknown sort field "%s"`, by), http.StatusBadRequest)
+		return
+	}
+
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "html" {
+		http.Error(w, fmt.Sprintf(`unknown format "%s"`, format), http.StatusBadRequest)
+		return
+	}
+
+	var filters []cache.StatFilter
+	if prefix := q.Get("prefix"); prefix != "" {
+		filters = append(filters, cache.FilterKeyPrefix(prefix))
+	}
+	if expired {
+		filters = append(filters, cache.FilterExpired())
+	}
+	if inProgress {
+		filters = append(filters, cache.FilterInProgress())
+	}
+
+	var filter cache.StatFilter
+	if len(filters) > 0 {
+		filter = func(st *cache.Stat) bool {
+			for _, f := range filters {
+				if !f(st) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	stats := h.cache.GetStatFiltered(filter)
+	if by != cache.SortByKey || desc {
+		stats.SortBy(by, desc)
+	}
+
+	now := h.cache.Now()
+	info := make([]cache.StatInfo, len(stats))
+	for i := range stats {
+		info[i] = stats[i].Info(now)
+	}
+
+	if format == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := htmlTemplate.Execute(w, info); err != nil {
+			cache.Log.Message(log.ERR, "stats html: %s", err)
+		}
+		return
+	}
+
+	j, err := jsonw.Marshal(info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(j)
+}
+
+// Необязательный флаг запроса, отсутствующий или пустой - false
+func flag(q url.Values, name string) (bool, error) {
+	s := q.Get(name)
+	if s == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf(`bad value "%s" of %s`, s, name)
+	}
+
+	return b, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+var htmlTemplate = template.Must(template.New("stats").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Cache stats</title></head>
+<body>
+<table border="1" cellspacing="0" cellpadding="3">
+<tr><th>Key</th><th>Description</th><th>Code</th><th>Filled</th><th>In progress</th><th>Expired</th><th>TTL, s</th><th>Uses</th><th>Updates</th><th>Size</th></tr>
+{{range .}}<tr><td>{{.Key}}</td><td>{{.Description}}</td><td>{{.Code}}</td><td>{{.Filled}}</td><td>{{.InProgress}}</td><td>{{.Expired}}</td><td>{{printf "%.1f" .TTLSeconds}}</td><td>{{.Uses}}</td><td>{{.Updates}}</td><td>{{.Size}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,115 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alrusov/config"
+
+	"github.com/alrusov/cache"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func testCache(t *testing.T) *cache.Cache {
+	c := cache.NewWithConfig(&cache.Config{DisableGC: true})
+	t.Cleanup(c.Close)
+
+	for i, key := range []string{"b", "a", "c"} {
+		e, _, _ := c.Get(0, key, "")
+		e.Commit(0, i, 200, config.Duration(time.Hour))
+	}
+
+	// Устаревший
+	e, _, _ := c.Get(0, "old", "")
+	e.Commit(0, 0, 200, config.Duration(time.Nanosecond))
+	time.Sleep(time.Millisecond)
+
+	// В процессе заполнения
+	e, _, _ = c.Get(0, "new", "")
+	t.Cleanup(func() { e.Abort(0) })
+
+	return c
+}
+
+func request(t *testing.T, h http.Handler, method string, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, "/stats"+query, nil))
+	return w
+}
+
+func keys(t *testing.T, w *httptest.ResponseRecorder) string {
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+
+	var info []cache.StatInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+
+	list := make([]string, len(info))
+	for i := range info {
+		list[i] = info[i].Key
+	}
+	return strings.Join(list, ",")
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestJSON(t *testing.T) {
+	h := New(testCache(t))
+
+	w := request(t, h, http.MethodGet, "")
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Fatalf("content type %s", ct)
+	}
+
+	for query, expected := range map[string]string{
+		"":                                "a,b,c,new,old",
+		"?format=json&desc=1":             "old,new,c,b,a",
+		"?sort=numberOfUpdates&desc=true": "a,b,c,old,new",
+		"?prefix=o":                       "old",
+		"?expired=1":                      "old",
+		"?inProgress=1":                   "new",
+		"?expired=0&inProgress=false":     "a,b,c,new,old",
+	} {
+		if k := keys(t, request(t, h, http.MethodGet, query)); k != expected {
+			t.Errorf("%q: got %s, expected %s", query, k, expected)
+		}
+	}
+}
+
+func TestHTML(t *testing.T) {
+	h := New(testCache(t))
+
+	w := request(t, h, http.MethodGet, "?format=html&prefix=a")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("status %d, content type %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	if body := w.Body.String(); !strings.Contains(body, "<td>a</td>") || strings.Contains(body, "<td>b</td>") {
+		t.Fatalf("unexpected body %s", body)
+	}
+}
+
+func TestBadRequest(t *testing.T) {
+	h := New(testCache(t))
+
+	for _, query := range []string{"?sort=unknown", "?desc=maybe", "?expired=x", "?inProgress=2", "?format=xml"} {
+		if w := request(t, h, http.MethodGet, query); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d", query, w.Code)
+		}
+	}
+
+	w := request(t, h, http.MethodPost, "")
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Fatalf("status %d, allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
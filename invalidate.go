@@ -0,0 +1,44 @@
+package cache
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Передача явного удаления в OnInvalidate, вызывается без блокировок
+func (c *Cache) publishInvalidation(hashes []string, tags []string) {
+	if c.onInvalidate == nil || (len(hashes) == 0 && len(tags) == 0) {
+		return
+	}
+
+	c.onInvalidate(hashes, tags)
+}
+
+// Применение удаления, полученного от другого экземпляра через OnInvalidate: удаляются элементы с hash из hashes
+// и с тегами из tags. OnInvalidate при этом не вызывается, чтобы удаление не передавалось по кругу.
+// Возвращает количество удалённых
+func ApplyInvalidation(hashes []string, tags ...string) int {
+	return Global().ApplyInvalidation(hashes, tags...)
+}
+
+func (c *Cache) ApplyInvalidation(hashes []string, tags ...string) (n int) {
+	for _, hash := range hashes {
+		hkey := c.hashKey(hash)
+
+		s := c.shard(hkey)
+		s.Lock()
+		if e, exists := s.data[hkey]; exists {
+			s.delete(e)
+			e.debug(0, "invalidated")
+			n++
+		}
+		s.unlock()
+	}
+
+	for _, tag := range tags {
+		c.forEachShard(func(s *shard) {
+			n += s.invalidateTag(tag, nil)
+		})
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
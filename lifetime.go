@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/log"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	prefixLifetime struct {
+		prefix   string
+		lifetime config.Duration
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Время жизни по умолчанию для ключей, начинающихся с prefix, используется в Commit при переданном 0.
+// Из нескольких подходящих префиксов выбирается самый длинный. lifetime == 0 - удалить ранее заданное значение.
+// Порядок выбора: явно переданное в Commit время жизни, затем LifetimePolicy по коду (если задано),
+// для отрицательного результата - NegativeLifetime (если задано), затем значение по префиксу, затем DefaultLifetime.
+// MaxLifetime ограничивает любое из них
+func SetDefaultLifetime(prefix string, lifetime config.Duration) {
+	Global().SetDefaultLifetime(prefix, lifetime)
+}
+
+func (c *Cache) SetDefaultLifetime(prefix string, lifetime config.Duration) {
+	c.prefixLifetimesMutex.Lock()
+	defer c.prefixLifetimesMutex.Unlock()
+
+	list := make([]prefixLifetime, 0, len(c.prefixLifetimes)+1)
+	for _, pl := range c.prefixLifetimes {
+		if pl.prefix != prefix {
+			list = append(list, pl)
+		}
+	}
+
+	if lifetime != 0 {
+		list = append(list, prefixLifetime{prefix: prefix, lifetime: lifetime})
+		sort.SliceStable(list, func(i, j int) bool { return len(list[i].prefix) > len(list[j].prefix) })
+	}
+
+	c.prefixLifetimes = list
+}
+
+// Время жизни по умолчанию для ключа key по префиксу, 0 - не задано
+func (c *Cache) prefixLifetime(key string) config.Duration {
+	c.prefixLifetimesMutex.RLock()
+	defer c.prefixLifetimesMutex.RUnlock()
+
+	for _, pl := range c.prefixLifetimes {
+		if strings.HasPrefix(key, pl.prefix) {
+			return pl.lifetime
+		}
+	}
+
+	return 0
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Изменение во время работы всех времён жизни в f раз, например, уменьшение при инциденте или увеличение для защиты
+// перегруженного источника. Действует только на последующие Commit и Touch, уже сохранённые элементы не меняются.
+// Не действует на неустаревающие данные, результат ограничивается MaxLifetime. f <= 0 - без изменения (1)
+func SetLifetimeMultiplier(f float64) {
+	Global().SetLifetimeMultiplier(f)
+}
+
+func (c *Cache) SetLifetimeMultiplier(f float64) {
+	if f <= 0 {
+		f = 1
+	}
+
+	c.lifetimeMultiplier.Store(math.Float64bits(f))
+	c.message(log.INFO, "lifetime multiplier is set to %g", f)
+}
+
+// Текущий множитель времени жизни
+func (c *Cache) LifetimeMultiplier() float64 {
+	bits := c.lifetimeMultiplier.Load()
+	if bits == 0 {
+		return 1
+	}
+
+	return math.Float64frombits(bits)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Время жизни для Commit элемента с ключом key и кодом code: 0 - по умолчанию (порядок выбора см. в SetDefaultLifetime),
+// < 0 - без устаревания (0). При заданном MaxLifetime большие значения, включая отсутствие устаревания, ограничиваются им
+func (c *Cache) lifetime(key string, code int, lifetime config.Duration, negative bool) config.Duration {
+	if lifetime == 0 && c.lifetimePolicy != nil {
+		lifetime = c.lifetimePolicy(code)
+	}
+
+	if lifetime == 0 && negative {
+		lifetime = c.negativeLifetime
+	}
+
+	if lifetime == 0 {
+		lifetime = c.prefixLifetime(key)
+	}
+
+	if lifetime == 0 {
+		lifetime = c.defaultLifetime
+	}
+
+	if lifetime < 0 {
+		lifetime = 0
+	}
+
+	if f := c.LifetimeMultiplier(); f != 1 && lifetime > 0 {
+		lifetime = config.Duration(float64(lifetime) * f)
+	}
+
+	if c.maxLifetime > 0 && (lifetime == 0 || lifetime > c.maxLifetime) {
+		if c.log.CurrentLogLevel() >= log.DEBUG {
+			c.message(log.DEBUG, "lifetime %s is limited to %s", lifetime.D(), c.maxLifetime.D())
+		}
+		lifetime = c.maxLifetime
+	}
+
+	return lifetime
+}
+
+// Время окончания жизни данных, обновлённых в from.
+// При заданном JitterFraction время жизни случайно уменьшается на долю до JitterFraction,
+// чтобы одновременно созданные элементы не устаревали одновременно
+func (c *Cache) expiration(from time.Time, lifetime config.Duration) time.Time {
+	d := lifetime.D()
+
+	if c.jitterFraction > 0 && d > 0 {
+		c.jitterMutex.Lock()
+		r := c.jitterRand.Float64()
+		c.jitterMutex.Unlock()
+
+		d -= time.Duration(float64(d) * c.jitterFraction * r)
+	}
+
+	if d <= 0 {
+		// Не устаревает
+		return time.Time{}
+	}
+
+	return from.Add(d)
+}
+
+// Начальное значение источника случайных чисел для разброса времени жизни: передав его в Config.JitterSeed,
+// можно воспроизвести ту же последовательность. 0 - источник задан в Config.JitterSource.
+// Разброс выключается JitterFraction == 0 (по умолчанию)
+func (c *Cache) JitterSeed() int64 {
+	return c.jitterSeed
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Заполненные данные не устаревают
+func (d *def) forever() bool {
+	return d.Filled && d.ExparedAt.IsZero()
+}
+
+// Данные актуальны на момент now
+func (d *def) fresh(now time.Time) bool {
+	return d.ExparedAt.IsZero() || now.Before(d.ExparedAt)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Счётчики кеша в целом
+	Metrics struct {
+		Fresh      uint64        `json:"fresh"`      // Отдано актуальных данных
+		Stale      uint64        `json:"stale"`      // Отдано устаревших данных (во время обновления другим)
+		Misses     uint64        `json:"misses"`     // Выдано на заполнение
+		Created    uint64        `json:"created"`    // Создано новых элементов
+		Waited     uint64        `json:"waited"`     // Ожиданий заполнения другим
+		Timeouts   uint64        `json:"timeouts"`   // Не дождались заполнения другим
+		Filled     uint64        `json:"filled"`     // Заполнено (Commit)
+		Aborted    uint64        `json:"aborted"`    // Отменено заполнений (Abort)
+		Collisions uint64        `json:"collisions"` // Коллизий hash (обнаруженных при поиске)
+		FillTime   time.Duration `json:"fillTime"`   // Суммарная длительность заполнений (от выдачи на заполнение до Commit)
+	}
+
+	metrics struct {
+		fresh      atomic.Uint64
+		stale      atomic.Uint64
+		misses     atomic.Uint64
+		created    atomic.Uint64
+		waited     atomic.Uint64
+		timeouts   atomic.Uint64
+		filled     atomic.Uint64
+		aborted    atomic.Uint64
+		collisions atomic.Uint64
+		fillTime   atomic.Uint64 // time.Duration
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func GetMetrics() Metrics {
+	return Global().Metrics()
+}
+
+// Текущие значения счётчиков. Блокировка кеша не используется, поэтому значения могут быть
+// не вполне согласованы между собой
+func (c *Cache) Metrics() Metrics {
+	m := &c.metrics
+
+	return Metrics{
+		Fresh:      m.fresh.Load(),
+		Stale:      m.stale.Load(),
+		Misses:     m.misses.Load(),
+		Created:    m.created.Load(),
+		Waited:     m.waited.Load(),
+		Timeouts:   m.timeouts.Load(),
+		Filled:     m.filled.Load(),
+		Aborted:    m.aborted.Load(),
+		Collisions: m.collisions.Load(),
+		FillTime:   time.Duration(m.fillTime.Load()),
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Количество элементов и суммарные счётчики использований и обновлений по всем элементам.
+// Дешевле GetStat, так как ничего не копирует, но всё равно просматривает все элементы под блокировками частей хранилища
+func (c *Cache) Totals() (entries int, uses uint64, updates uint64) {
+	c.forEachShardRead(func(s *shard) {
+		entries += len(s.data)
+
+		for _, e := range s.data {
+			uses = saturatedAdd(uses, e.NumberOfUses)
+			updates = saturatedAdd(updates, e.NumberOfUpdates)
+		}
+	})
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Доля обращений, обслуженных из кеша (актуальными или устаревшими данными)
+func (m Metrics) HitRatio() float64 {
+	hits := m.Fresh + m.Stale
+	total := hits + m.Misses
+	if total == 0 {
+		return 0
+	}
+
+	return float64(hits) / float64(total)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Средняя длительность заполнения
+func (m Metrics) AvgFillTime() time.Duration {
+	if m.Filled == 0 {
+		return 0
+	}
+
+	return m.FillTime / time.Duration(m.Filled)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
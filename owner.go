@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/alrusov/log"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Токен заполнения: уникален для каждой выдачи элемента на заполнение, 0 - нет.
+	// Защищает от Commit/Abort устаревшего владельца, если *Elem попал к тому, кто уже не отвечает за его заполнение
+	FillToken uint64
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Начало заполнения, вызывается под блокировкой
+func (e *Elem) startFill(now time.Time) {
+	e.InProgressFrom = now
+	e.token = FillToken(e.cache.fillTokens.Add(1))
+}
+
+// Токен текущего заполнения элемента, 0 - не в процессе заполнения.
+// Имеет смысл только сразу после получения элемента на заполнение, пока он не сохранён и не отменён
+func (e *Elem) Token() FillToken {
+	e.shard.RLock()
+	defer e.shard.RUnlock()
+
+	if e.InProgressFrom.IsZero() {
+		return 0
+	}
+	return e.token
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// То же, что и Get, но для e != nil возвращает и токен заполнения, который надо передать в Commit (CommitOptions.Token)
+// или AbortWithToken. Commit или Abort с токеном предыдущего заполнения отвергаются
+func GetWithToken(id uint64, key string, description string, extra ...any) (e *Elem, token FillToken, data any, code int) {
+	return Global().GetWithToken(id, key, description, extra...)
+}
+
+func (c *Cache) GetWithToken(id uint64, key string, description string, extra ...any) (e *Elem, token FillToken, data any, code int) {
+	e, data, code = c.Get(id, key, description, extra...)
+	if e != nil {
+		// Завершить заполнение может только получивший элемент, поэтому токен до возврата из GetWithToken не изменится
+		token = e.Token()
+	}
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Abort только для заполнения с этим токеном, иначе ErrNotOwner и элемент не меняется (0 - без проверки, как Abort).
+// Уже завершённое заполнение, как и в Abort, не трогается
+func (e *Elem) AbortWithToken(id uint64, token FillToken) error {
+	e.shard.Lock()
+	defer e.shard.unlock()
+
+	if token != 0 && !e.InProgressFrom.IsZero() && token != e.token {
+		e.cache.message(log.WARNING, `[%d] "%s": abort with the token of another fill, ignored`, id, e.Key)
+		return ErrNotOwner
+	}
+
+	e.abortLocked(id)
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
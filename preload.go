@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"github.com/alrusov/config"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Данные для Preload
+	PreloadSpec struct {
+		Key         string
+		Description string
+		Extra       []any
+		Data        any
+		Code        int
+		Lifetime    config.Duration // Как в Commit
+		Options     *CommitOptions  // Как в CommitEx, nil - без них
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Заполнение кеша заранее (например, при старте) без Get: элементы создаются и сразу сохраняются, как при Commit.
+// Существующие данные заменяются, кроме элементов, находящихся в процессе заполнения другим, - их не трогаем.
+// Можно вызывать одновременно с обычной работой. Возвращает количество сохранённых
+func Preload(entries []PreloadSpec) int {
+	return Global().Preload(entries)
+}
+
+func (c *Cache) Preload(entries []PreloadSpec) (n int) {
+	for i := range entries {
+		p := &entries[i]
+
+		e := c.preloadElem(p)
+		if e == nil {
+			continue
+		}
+
+		if _, err := e.commit(0, p.Data, p.Code, p.Lifetime, p.Options); err == nil {
+			n++
+		}
+	}
+
+	return
+}
+
+// Элемент для Preload, захваченный на заполнение, nil - не трогаем
+func (c *Cache) preloadElem(p *PreloadSpec) (e *Elem) {
+	if c.closed.Load() {
+		return nil
+	}
+
+	hkey, hash, check := c.mustHash(p.Key, p.Extra)
+
+	s := c.shard(hkey)
+	s.Lock()
+	defer s.unlock()
+
+	now := c.now()
+
+	e, exists := s.data[hkey]
+	switch {
+	case !exists:
+		e = s.add(0, p.Key, hkey, hash, check, now)
+	case !e.matches(p.Key, check) || !e.InProgressFrom.IsZero():
+		return nil
+	}
+
+	e.startFill(now)
+	e.Description = p.Description
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,85 @@
+// Сборщик метрик кеша для Prometheus.
+// Вынесен в отдельный модуль, чтобы не тянуть зависимость от Prometheus в основной пакет
+package promcollector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/alrusov/cache"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Реализация prometheus.Collector для *cache.Cache
+	Collector struct {
+		cache *cache.Cache
+
+		entries  *prometheus.Desc
+		uses     *prometheus.Desc
+		updates  *prometheus.Desc
+		hitRatio *prometheus.Desc
+		requests *prometheus.Desc
+		waits    *prometheus.Desc
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Новый сборщик для кеша c (nil - глобальный), name попадает в метку "cache"
+func New(name string, c *cache.Cache) *Collector {
+	if c == nil {
+		c = cache.Global()
+	}
+
+	labels := prometheus.Labels{"cache": name}
+
+	return &Collector{
+		cache: c,
+
+		entries:  prometheus.NewDesc("cache_entries", "Number of entries", nil, labels),
+		uses:     prometheus.NewDesc("cache_entry_uses", "Number of uses summed over the current entries", nil, labels),
+		updates:  prometheus.NewDesc("cache_entry_updates", "Number of updates summed over the current entries", nil, labels),
+		hitRatio: prometheus.NewDesc("cache_hit_ratio", "Share of requests served from the cache", nil, labels),
+		requests: prometheus.NewDesc("cache_requests_total", "Number of requests by result", []string{"result"}, labels),
+		waits:    prometheus.NewDesc("cache_waits_total", "Number of waits for a fill by another caller", nil, labels),
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Describe --
+func (x *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- x.entries
+	ch <- x.uses
+	ch <- x.updates
+	ch <- x.hitRatio
+	ch <- x.requests
+	ch <- x.waits
+}
+
+// Collect --
+func (x *Collector) Collect(ch chan<- prometheus.Metric) {
+	entries, uses, updates := x.cache.Totals()
+	m := x.cache.Metrics()
+
+	ch <- prometheus.MustNewConstMetric(x.entries, prometheus.GaugeValue, float64(entries))
+	// Суммы по имеющимся элементам уменьшаются при удалении и сбросе статистики, поэтому это не счётчики
+	ch <- prometheus.MustNewConstMetric(x.uses, prometheus.GaugeValue, float64(uses))
+	ch <- prometheus.MustNewConstMetric(x.updates, prometheus.GaugeValue, float64(updates))
+	ch <- prometheus.MustNewConstMetric(x.hitRatio, prometheus.GaugeValue, m.HitRatio())
+
+	for result, v := range map[string]uint64{
+		"fresh":   m.Fresh,
+		"stale":   m.Stale,
+		"miss":    m.Misses,
+		"timeout": m.Timeouts,
+	} {
+		ch <- prometheus.MustNewConstMetric(x.requests, prometheus.CounterValue, float64(v), result)
+	}
+
+	// Дождавшийся заполнения другим учитывается и в requests по итоговому результату, поэтому ожидания - отдельно
+	ch <- prometheus.MustNewConstMetric(x.waits, prometheus.CounterValue, float64(m.Waited))
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
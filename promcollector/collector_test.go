@@ -0,0 +1,65 @@
+package promcollector
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alrusov/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/alrusov/cache"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCollector(t *testing.T) {
+	c := cache.New()
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 0, config.Duration(0))
+	c.Get(0, "a", "")
+
+	x := New("test", c)
+
+	if n := testutil.CollectAndCount(x); n != 9 {
+		t.Fatalf("got %d metrics", n)
+	}
+
+	expected := `
+# HELP cache_entries Number of entries
+# TYPE cache_entries gauge
+cache_entries{cache="test"} 1
+# HELP cache_entry_uses Number of uses summed over the current entries
+# TYPE cache_entry_uses gauge
+cache_entry_uses{cache="test"} 2
+# HELP cache_entry_updates Number of updates summed over the current entries
+# TYPE cache_entry_updates gauge
+cache_entry_updates{cache="test"} 1
+`
+	if err := testutil.CollectAndCompare(x, strings.NewReader(expected), "cache_entries", "cache_entry_uses", "cache_entry_updates"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = `
+# HELP cache_requests_total Number of requests by result
+# TYPE cache_requests_total counter
+cache_requests_total{cache="test",result="fresh"} 1
+cache_requests_total{cache="test",result="miss"} 1
+cache_requests_total{cache="test",result="stale"} 0
+cache_requests_total{cache="test",result="timeout"} 0
+`
+	if err := testutil.CollectAndCompare(x, strings.NewReader(expected), "cache_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = `
+# HELP cache_waits_total Number of waits for a fill by another caller
+# TYPE cache_waits_total counter
+cache_waits_total{cache="test"} 0
+`
+	if err := testutil.CollectAndCompare(x, strings.NewReader(expected), "cache_waits_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
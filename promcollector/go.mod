@@ -0,0 +1,34 @@
+module github.com/alrusov/cache/promcollector
+
+go 1.22.5
+
+require (
+	github.com/alrusov/cache v0.0.0-20261014183533-48a9a5fbeef2
+	github.com/alrusov/config v0.1.59
+	github.com/prometheus/client_golang v1.20.5
+)
+
+require (
+	github.com/alrusov/initializer v0.1.2 // indirect
+	github.com/alrusov/jsonw v0.1.3 // indirect
+	github.com/alrusov/log v0.1.39 // indirect
+	github.com/alrusov/misc v1.1.15 // indirect
+	github.com/alrusov/panic v0.1.15 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/json-iterator/go v1.1.12 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/naoina/go-stringutil v0.1.0 // indirect
+	github.com/naoina/toml v0.1.1 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
+)
+
+// Для разработки в этом репозитории, потребителями модуля не учитывается
+replace github.com/alrusov/cache => ../
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"sync"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+var (
+	registry      = map[string]*Cache{} // Именованные кеши
+	registryMutex sync.Mutex
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Именованный кеш. При первом обращении создаётся с настройками по умолчанию и именем name.
+// Глобальный кеш (Global) в реестр не входит
+func GetCache(name string) (c *Cache) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	c, exists := registry[name]
+	if !exists {
+		c = NewWithConfig(&Config{Name: name})
+		registry[name] = c
+	}
+
+	return
+}
+
+// Зарегистрировать созданный кеш под именем name, например, с собственными настройками.
+// Ранее зарегистрированный под этим именем кеш заменяется (но не закрывается) и возвращается.
+// c == nil - то же, что и UnregisterCache
+func RegisterCache(name string, c *Cache) (old *Cache) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	old = registry[name]
+	if c == nil {
+		delete(registry, name)
+	} else {
+		registry[name] = c
+	}
+	return
+}
+
+// Исключить кеш из реестра. Кеш не закрывается и возвращается, nil - под этим именем ничего не было
+func UnregisterCache(name string) (old *Cache) {
+	return RegisterCache(name, nil)
+}
+
+// Статистика всех именованных кешей
+func AllStats() (all map[string]Stats) {
+	registryMutex.Lock()
+	list := make(map[string]*Cache, len(registry))
+	for name, c := range registry {
+		list[name] = c
+	}
+	registryMutex.Unlock()
+
+	all = make(map[string]Stats, len(list))
+	for name, c := range list {
+		all[name] = c.GetStat()
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,227 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Часть хранилища со своей блокировкой. Элемент всегда находится в части, определяемой его ключом,
+	// поэтому ожидание и заполнение элемента координируются блокировкой только этой части.
+	// Только читающие операции (Peek, Len, GetStat и т.п.) берут блокировку на чтение и друг другу не мешают.
+	// sync.Cond элементов привязан к блокировке на запись: Wait, Broadcast и всё, что меняет элементы,
+	// выполняются только под ней
+	shard struct {
+		sync.RWMutex
+		cache       *Cache
+		data        elems
+		lru         *list.List                   // Порядок использования элементов, в начале последние использованные
+		tags        map[string]map[hashKey]*Elem // Элементы по тегам
+		hooks       []func()                     // Обработчики (OnEvict, OnCommit), вызываемые после снятия блокировки
+		bytes       int64                        // Суммарный размер данных элементов части
+		prioritized int                          // Количество элементов с ненулевым приоритетом
+		peak        int                          // Наибольшее количество элементов с последнего пересоздания data
+		filled      *sync.Cond                   // Для WaitFilled: сигнал о заполнении любого элемента части
+		fillWaiters int                          // Количество ожидающих в WaitFilled
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Часть хранилища для ключа
+func (c *Cache) shard(hkey hashKey) *shard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+
+	// Первые байты FNV перемешаны плохо, поэтому сворачиваем все 16 и перемешиваем (финализатор murmur3)
+	h := binary.LittleEndian.Uint64(hkey[:8]) ^ binary.LittleEndian.Uint64(hkey[8:])
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return c.shards[h%uint64(len(c.shards))]
+}
+
+// Снятие блокировки с последующим вызовом накопленных под ней обработчиков
+func (s *shard) unlock() {
+	hooks := s.hooks
+	s.hooks = nil
+	s.Unlock()
+
+	for _, f := range hooks {
+		f()
+	}
+}
+
+// Запоминание удалённого элемента для OnEvict и подписчиков, вызывается под блокировкой.
+// Незаполненные элементы не учитываются
+func (s *shard) addEvicted(e *Elem) {
+	if !e.Filled {
+		return
+	}
+
+	s.addEvent(EventEvict, e)
+
+	if s.cache.onEvict == nil {
+		return
+	}
+
+	key, data := e.Key, e.Data
+	s.hooks = append(s.hooks, func() { s.cache.onEvict(key, s.cache.decodeData(key, data)) })
+}
+
+// Запоминание выдачи устаревших данных для OnStaleHit, вызывается под блокировкой
+func (s *shard) staleHit(key string) {
+	if s.cache.onStaleHit == nil {
+		return
+	}
+
+	s.hooks = append(s.hooks, func() { s.cache.onStaleHit(key) })
+}
+
+// Выполнить f для каждой части хранилища под её блокировкой
+func (c *Cache) forEachShard(f func(s *shard)) {
+	for _, s := range c.shards {
+		s.Lock()
+		f(s)
+		s.unlock()
+	}
+}
+
+// То же, что и forEachShard, но под блокировкой на чтение - f не должна ничего менять
+func (c *Cache) forEachShardRead(f func(s *shard)) {
+	for _, s := range c.shards {
+		s.RLock()
+		f(s)
+		s.RUnlock()
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Добавление элемента в хранилище, вызывается под блокировкой
+func (s *shard) insert(e *Elem) {
+	s.data[e.hkey] = e
+	s.cache.entries.Add(1)
+	e.lru = s.lru.PushFront(e)
+
+	if len(s.data) > s.peak {
+		s.peak = len(s.data)
+	}
+}
+
+// Явное удаление элемента (Delete и т.п.), вызывается под блокировкой. В отличие от remove, заполнение находящегося
+// в процессе элемента отменяется: его Commit ничего не сохраняет, а ожидающие получают CodeDeleted
+func (s *shard) delete(e *Elem) {
+	if !e.InProgressFrom.IsZero() {
+		e.deleted = true
+	}
+
+	s.remove(e)
+}
+
+// Удаление элемента из хранилища, вызывается под блокировкой.
+// Ожидающие заполнения элемента просыпаются и начинают заново
+func (s *shard) remove(e *Elem) {
+	if s.unlink(e) {
+		s.addEvicted(e)
+		e.releaseData()
+	}
+
+	e.cond.Broadcast()
+}
+
+// Исключение элемента из хранилища без OnEvict и подписчиков (Take - данные отданы вызывающему),
+// вызывается под блокировкой. Возвращает false, если элемента в хранилище уже нет
+func (s *shard) unlink(e *Elem) bool {
+	if s.data[e.hkey] != e {
+		return false
+	}
+
+	delete(s.data, e.hkey)
+	s.cache.entries.Add(-1)
+	s.lru.Remove(e.lru)
+	e.lru = nil
+	s.addBytes(-e.Size)
+	if e.Priority != 0 {
+		s.prioritized--
+	}
+	s.unindexTags(e)
+	return true
+}
+
+// Удаление всех элементов, вызывается под блокировкой. Возвращает количество удалённых.
+// cancel - заполнения находящихся в процессе элементов отменяются, как в delete
+func (s *shard) clear(cancel bool) (n int) {
+	data := s.data
+	s.data = make(elems, s.cache.initialCapacity)
+	s.peak = 0
+
+	s.cache.entries.Add(-int64(len(data)))
+	s.lru.Init()
+	s.addBytes(-s.bytes)
+	s.prioritized = 0
+	s.tags = make(map[string]map[hashKey]*Elem)
+
+	for _, e := range data {
+		if cancel && !e.InProgressFrom.IsZero() {
+			e.deleted = true
+		}
+		e.lru = nil
+		s.addEvicted(e)
+		e.releaseData()
+		e.cond.Broadcast()
+	}
+
+	return len(data)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Сборщик мусора пересоздаёт data, если элементов стало меньше, чем 1/compactRatio от наибольшего количества
+const compactRatio = 4
+
+// Пересоздание data, если элементов стало меньше, чем 1/ratio от наибольшего количества, вызывается под блокировкой.
+// Map в Go после удалений не уменьшается, поэтому после всплеска память можно вернуть только так.
+// Сами элементы не меняются, поэтому ожидание и заполнение не затрагиваются. Возвращает true, если пересоздано
+func (s *shard) compact(ratio int) bool {
+	if s.peak <= s.cache.initialCapacity || len(s.data)*ratio >= s.peak {
+		return false
+	}
+
+	data := make(elems, max(len(s.data), s.cache.initialCapacity))
+	for hkey, e := range s.data {
+		data[hkey] = e
+	}
+
+	s.data = data
+	s.peak = len(data)
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Пересоздание хранилища в частях, где элементов стало меньше, чем было в пике, чтобы освободить память
+// после массового удаления. Сборщик мусора делает это сам, когда элементов становится меньше четверти от пика.
+// Возвращает количество пересозданных частей
+func Compact() int {
+	return Global().Compact()
+}
+
+func (c *Cache) Compact() (n int) {
+	c.forEachShard(func(s *shard) {
+		if s.compact(1) {
+			n++
+		}
+	})
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
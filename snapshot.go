@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/alrusov/jsonw"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Восстановление данных элемента из снимка
+	DecodeFunc func(key string, data []byte) (any, error)
+
+	snapshot struct {
+		Version int              `json:"version"`
+		Entries []snapshotRecord `json:"entries"`
+	}
+
+	snapshotRecord struct {
+		def
+		Data json.RawMessage `json:"data"`
+	}
+)
+
+const (
+	snapshotVersion = 1
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Сохранить заполненные элементы вместе с данными в w (JSON).
+// Данные сериализуются через JSON, поэтому сохраняются только их экспортируемые поля
+func Save(w io.Writer) (n int, err error) {
+	return Global().Save(w)
+}
+
+func (c *Cache) Save(w io.Writer) (n int, err error) {
+	type item struct {
+		def  def
+		data any
+	}
+
+	var list []item
+
+	c.forEachShardRead(func(s *shard) {
+		for _, e := range s.data {
+			if e.Filled {
+				list = append(list, item{def: e.def, data: c.decodeData(e.Key, e.Data)})
+			}
+		}
+	})
+
+	ss := snapshot{
+		Version: snapshotVersion,
+		Entries: make([]snapshotRecord, 0, len(list)),
+	}
+
+	for _, it := range list {
+		j, err := jsonw.Marshal(it.data)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", it.def.Key, err)
+		}
+
+		ss.Entries = append(ss.Entries, snapshotRecord{def: it.def, Data: j})
+	}
+
+	j, err := jsonw.Marshal(ss)
+	if err != nil {
+		return
+	}
+
+	_, err = w.Write(j)
+	if err != nil {
+		return
+	}
+
+	return len(ss.Entries), nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Загрузить элементы, сохранённые Save. Устаревшие пропускаются, время окончания жизни остальных сохраняется.
+// Уже существующие элементы не заменяются. decode восстанавливает данные нужного типа,
+// nil - данные восстанавливаются как из JSON в any (map[string]any, []any, float64 и т.п.).
+// Кеш должен использовать ту же HashFunc, что и при сохранении
+func Load(r io.Reader, decode DecodeFunc) (n int, err error) {
+	return Global().Load(r, decode)
+}
+
+func (c *Cache) Load(r io.Reader, decode DecodeFunc) (n int, err error) {
+	j, err := io.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	var ss snapshot
+	err = jsonw.Unmarshal(j, &ss)
+	if err != nil {
+		return
+	}
+
+	if ss.Version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", ss.Version)
+	}
+
+	if decode == nil {
+		decode = func(key string, data []byte) (v any, err error) {
+			err = jsonw.Unmarshal(data, &v)
+			return
+		}
+	}
+
+	now := c.now()
+
+	for _, rec := range ss.Entries {
+		if !rec.fresh(now) {
+			continue
+		}
+
+		data, err := decode(rec.Key, rec.Data)
+		if err != nil {
+			return n, fmt.Errorf("%s: %s", rec.Key, err)
+		}
+
+		if c.restore(rec.def, data) {
+			n++
+		}
+	}
+
+	return
+}
+
+// Восстановление заполненного элемента. Возвращает false, если такой уже есть
+func (c *Cache) restore(d def, data any) bool {
+	if c.closed.Load() {
+		return false
+	}
+
+	hkey := c.hashKey(d.Hash)
+
+	s := c.shard(hkey)
+	s.Lock()
+	defer s.unlock()
+
+	if _, exists := s.data[hkey]; exists {
+		return false
+	}
+
+	e := s.newElem(0, d.Key, hkey, d.Hash, d.CreatedAt)
+	e.def = d
+	e.InProgressFrom = time.Time{}
+	e.Filled = true
+	e.Data = c.encodeData(d.Key, data)
+
+	s.evict(0)
+	s.insert(e)
+	s.notifyFilled()
+	s.setTags(e, d.Tags)
+	s.addBytes(e.Size)
+	if e.Priority != 0 {
+		s.prioritized++
+	}
+	s.evictBytes(0, e)
+
+	e.debug(0, "restored")
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,474 @@
+package cache
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Поле для сортировки Stats
+	SortField string
+
+	// Отбор элементов для GetStatFiltered, true - включить в результат
+	StatFilter func(st *Stat) bool
+)
+
+const (
+	SortByKey             SortField = "key"             // Ключ, затем описание и hash (как в GetStat)
+	SortByCreatedAt       SortField = "createdAt"       // Время создания
+	SortByLastUpdatedAt   SortField = "lastUpdatedAt"   // Время последнего обновления
+	SortByLastUsedAt      SortField = "lastUsedAt"      // Время последнего использования
+	SortByExparedAt       SortField = "exparedAt"       // Время окончания жизни
+	SortByNumberOfUses    SortField = "numberOfUses"    // Количество использований
+	SortByNumberOfUpdates SortField = "numberOfUpdates" // Количество обновлений
+)
+
+// Поле сортировки известно (иначе SortBy сортирует как по SortByKey)
+func (by SortField) Valid() bool {
+	switch by {
+	case SortByKey, SortByCreatedAt, SortByLastUpdatedAt, SortByLastUsedAt, SortByExparedAt, SortByNumberOfUses, SortByNumberOfUpdates:
+		return true
+	default:
+		return false
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// То же, что и GetStat, но с сортировкой по полю by, desc - по убыванию
+func GetStatSorted(by SortField, desc bool) (s Stats) {
+	return Global().GetStatSorted(by, desc)
+}
+
+func (c *Cache) GetStatSorted(by SortField, desc bool) (s Stats) {
+	s = c.GetStat()
+	s.SortBy(by, desc)
+	return
+}
+
+// Сортировка по полю by, desc - по убыванию. Сортировка устойчивая, поэтому для уже отсортированных
+// по умолчанию Stats равные элементы остаются упорядоченными по ключу.
+// Неизвестное поле - сортировка по ключу
+func (s Stats) SortBy(by SortField, desc bool) {
+	less := s.lessFunc(by)
+	if desc {
+		asc := less
+		less = func(i, j int) bool { return asc(j, i) }
+	}
+
+	sort.SliceStable(s, less)
+}
+
+func (s Stats) lessFunc(by SortField) func(i, j int) bool {
+	byTime := func(f func(st *Stat) time.Time) func(i, j int) bool {
+		return func(i, j int) bool { return f(&s[i]).Before(f(&s[j])) }
+	}
+
+	switch by {
+	case SortByCreatedAt:
+		return byTime(func(st *Stat) time.Time { return st.CreatedAt })
+	case SortByLastUpdatedAt:
+		return byTime(func(st *Stat) time.Time { return st.LastUpdatedAt })
+	case SortByLastUsedAt:
+		return byTime(func(st *Stat) time.Time { return st.LastUsedAt })
+	case SortByExparedAt:
+		return byTime(func(st *Stat) time.Time { return st.ExparedAt })
+	case SortByNumberOfUses:
+		return func(i, j int) bool { return s[i].NumberOfUses < s[j].NumberOfUses }
+	case SortByNumberOfUpdates:
+		return func(i, j int) bool { return s[i].NumberOfUpdates < s[j].NumberOfUpdates }
+	default:
+		return s.Less
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// То же, что и GetStat, но только для элементов, отобранных filter (nil - все).
+// filter вызывается под блокировкой части хранилища, поэтому он должен быть быстрым и не обращаться к кешу
+func GetStatFiltered(filter StatFilter) (s Stats) {
+	return Global().GetStatFiltered(filter)
+}
+
+func (c *Cache) GetStatFiltered(filter StatFilter) (s Stats) {
+	return c.getStat(false, filter)
+}
+
+// Заполненные, но устаревшие элементы
+func FilterExpired() StatFilter {
+	return func(st *Stat) bool {
+		return st.Filled && !st.fresh(st.now())
+	}
+}
+
+// Элементы в процессе заполнения
+func FilterInProgress() StatFilter {
+	return func(st *Stat) bool {
+		return !st.InProgressFrom.IsZero()
+	}
+}
+
+// Элементы с ключом, начинающимся с prefix
+func FilterKeyPrefix(prefix string) StatFilter {
+	return func(st *Stat) bool {
+		return strings.HasPrefix(st.Key, prefix)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Часть статистики для постраничного просмотра: не более limit элементов начиная с offset в порядке GetStat
+// (ключ, описание, при их совпадении - hash), total - общее количество элементов.
+// Сначала копируются только ключи для упорядочения, полностью копируются лишь элементы части.
+// Между этими шагами кеш может измениться: удалённые за это время элементы в часть не попадают.
+// limit <= 0 - до конца
+func GetStatPage(offset int, limit int) (page Stats, total int) {
+	return Global().GetStatPage(offset, limit)
+}
+
+func (c *Cache) GetStatPage(offset int, limit int) (page Stats, total int) {
+	type item struct {
+		key         string
+		description string
+		hash        string
+		hkey        hashKey
+	}
+
+	list := make([]item, 0, c.Len())
+	c.forEachShardRead(func(s *shard) {
+		for hkey, e := range s.data {
+			list = append(list, item{key: e.Key, description: e.Description, hash: e.Hash, hkey: hkey})
+		}
+	})
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := &list[i], &list[j]
+		return statLess(a.key, a.description, a.hash, b.key, b.description, b.hash)
+	})
+
+	total = len(list)
+
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= total {
+		return Stats{}, total
+	}
+
+	list = list[offset:]
+	if limit > 0 && limit < len(list) {
+		list = list[:limit]
+	}
+
+	now := c.now()
+	page = make(Stats, 0, len(list))
+	for _, it := range list {
+		s := c.shard(it.hkey)
+		s.RLock()
+		if e, exists := s.data[it.hkey]; exists {
+			page = append(page, Stat{def: e.def, Cache: c.name, Waiters: e.waiters, at: now})
+		}
+		s.RUnlock()
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Обнуление счётчиков использований и обновлений всех элементов, например, для подсчёта за период.
+// При политике вытеснения LFU после обнуления все элементы снова равноценны
+func ResetStats() {
+	Global().ResetStats()
+}
+
+func (c *Cache) ResetStats() {
+	c.forEachShard(func(s *shard) {
+		for _, e := range s.data {
+			e.resetStat()
+		}
+	})
+}
+
+// Обнуление счётчиков одного элемента. Возвращает false, если его нет
+func ResetStat(key string, extra ...any) bool {
+	return Global().ResetStat(key, extra...)
+}
+
+func (c *Cache) ResetStat(key string, extra ...any) bool {
+	hkey, _, check := c.mustHash(key, extra)
+
+	s := c.shard(hkey)
+	s.Lock()
+	defer s.unlock()
+
+	e, exists := s.data[hkey]
+	if !exists || !e.matches(key, check) {
+		return false
+	}
+
+	e.resetStat()
+	return true
+}
+
+// Вызывается под блокировкой
+func (e *Elem) resetStat() {
+	e.NumberOfUses = 0
+	e.NumberOfUpdates = 0
+}
+
+// Счётчики при переполнении не сбрасываются в 0, а остаются на максимуме
+func saturatedInc(n *uint64) {
+	if *n < math.MaxUint64 {
+		*n++
+	}
+}
+
+func saturatedAdd(a, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Вызов f для каждого элемента без копирования всего хранилища, как в GetStat. Обход прекращается, если f вернул false.
+// f вызывается под блокировкой части хранилища, поэтому он не должен обращаться к кешу (иначе взаимная блокировка)
+// и не должен изменять data (кроме копий при Config.Clone). Порядок обхода не определён
+func ForEach(f func(st Stat, data any) bool) {
+	Global().ForEach(f)
+}
+
+func (c *Cache) ForEach(f func(st Stat, data any) bool) {
+	for _, s := range c.shards {
+		if !s.forEach(f) {
+			return
+		}
+	}
+}
+
+func (s *shard) forEach(f func(st Stat, data any) bool) bool {
+	now := s.cache.now()
+
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, e := range s.data {
+		if !f(Stat{def: e.def, Cache: s.cache.name, Waiters: e.waiters, at: now}, s.cache.cloneData(e.Key, e.Data)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Различные исходные ключи (Key) элементов кеша по возрастанию. Элементы с одним ключом,
+// но разными extra дают один ключ
+func Keys() []string {
+	return Global().Keys()
+}
+
+func (c *Cache) Keys() []string {
+	set := make(map[string]struct{})
+	c.forEachShardRead(func(s *shard) {
+		for _, e := range s.data {
+			set[e.Key] = struct{}{}
+		}
+	})
+
+	list := make([]string, 0, len(set))
+	for key := range set {
+		list = append(list, key)
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+// hash (Elem.Hash) всех элементов кеша по возрастанию, например, для ApplyInvalidation в других экземплярах
+func Hashes() []string {
+	return Global().Hashes()
+}
+
+func (c *Cache) Hashes() (list []string) {
+	c.forEachShardRead(func(s *shard) {
+		for _, e := range s.data {
+			list = append(list, e.Hash)
+		}
+	})
+
+	sort.Strings(list)
+	return
+}
+
+// Различные ключи элементов, находящихся в процессе заполнения дольше threshold, по возрастанию.
+// Обычно это означает, что заполняющий завис или завершился без Commit и Abort, а ожидающие без ограничения
+// времени будут ждать вечно. Например, для проверки работоспособности
+func StuckEntries(threshold time.Duration) []string {
+	return Global().StuckEntries(threshold)
+}
+
+func (c *Cache) StuckEntries(threshold time.Duration) []string {
+	set := make(map[string]struct{})
+	now := c.now()
+
+	c.forEachShardRead(func(s *shard) {
+		for _, e := range s.data {
+			if !e.InProgressFrom.IsZero() && now.Sub(e.InProgressFrom) > threshold {
+				set[e.Key] = struct{}{}
+			}
+		}
+	})
+
+	list := make([]string, 0, len(set))
+	for key := range set {
+		list = append(list, key)
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Количество элементов
+func (s Stats) Count() int {
+	return len(s)
+}
+
+// Суммарное количество использований
+func (s Stats) TotalUses() (n uint64) {
+	for i := range s {
+		n = saturatedAdd(n, s[i].NumberOfUses)
+	}
+	return
+}
+
+// Суммарное количество обновлений
+func (s Stats) TotalUpdates() (n uint64) {
+	for i := range s {
+		n = saturatedAdd(n, s[i].NumberOfUpdates)
+	}
+	return
+}
+
+// Количество заполненных, но устаревших на момент получения статистики элементов
+func (s Stats) Expired() (n int) {
+	for i := range s {
+		if s[i].Filled && !s[i].fresh(s[i].now()) {
+			n++
+		}
+	}
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Представление Stat для внешних потребителей (HTTP и т.п.) со стабильной схемой JSON: в отличие от Stat,
+	// не зависит от внутреннего устройства элемента, поля не переименовываются и не удаляются, только добавляются.
+	// Длительности - в секундах
+	StatInfo struct {
+		Cache           string            `json:"cache,omitempty"` // Имя кеша
+		Key             string            `json:"key"`
+		Description     string            `json:"description,omitempty"`
+		Hash            string            `json:"hash"`
+		Filled          bool              `json:"filled"`
+		InProgress      bool              `json:"inProgress"`
+		Expired         bool              `json:"expired"`  // Заполнен, но устарел
+		Forever         bool              `json:"forever"`  // Заполнен и не устаревает
+		Negative        bool              `json:"negative"` // Отрицательный результат
+		Code            int               `json:"code"`
+		LifetimeSeconds float64           `json:"lifetimeSeconds"`
+		TTLSeconds      float64           `json:"ttlSeconds"` // Оставшееся время жизни, для устаревших - отрицательное, для неустаревающих и незаполненных - 0
+		CreatedAt       time.Time         `json:"createdAt"`
+		CreatedBy       uint64            `json:"createdBy,omitempty"`
+		UpdatedAt       *time.Time        `json:"updatedAt,omitempty"`
+		UpdatedBy       uint64            `json:"updatedBy,omitempty"`
+		UsedAt          *time.Time        `json:"usedAt,omitempty"`
+		ExpiresAt       *time.Time        `json:"expiresAt,omitempty"`
+		InProgressFrom  *time.Time        `json:"inProgressFrom,omitempty"`
+		Uses            uint64            `json:"uses"`
+		Updates         uint64            `json:"updates"`
+		Waiters         int               `json:"waiters"`
+		Size            int64             `json:"size"`
+		Priority        int               `json:"priority"`
+		FillSeconds     float64           `json:"fillSeconds"` // Длительность последнего заполнения
+		Tags            []string          `json:"tags,omitempty"`
+		Meta            map[string]string `json:"meta,omitempty"`
+	}
+)
+
+// Момент получения статистики по часам кеша, для созданных вызывающим Stat - текущее время
+func (st *Stat) now() time.Time {
+	if st.at.IsZero() {
+		return misc.NowUTC()
+	}
+	return st.at
+}
+
+// Представление для внешних потребителей на момент now
+func (st *Stat) Info(now time.Time) (info StatInfo) {
+	optTime := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+
+	info = StatInfo{
+		Cache:           st.Cache,
+		Key:             st.Key,
+		Description:     st.Description,
+		Hash:            st.Hash,
+		Filled:          st.Filled,
+		InProgress:      !st.InProgressFrom.IsZero(),
+		Expired:         st.Filled && !st.fresh(now),
+		Forever:         st.forever(),
+		Negative:        st.Negative,
+		Code:            st.Code,
+		LifetimeSeconds: st.Lifetime.D().Seconds(),
+		CreatedAt:       st.CreatedAt,
+		CreatedBy:       st.CreatedBy,
+		UpdatedAt:       optTime(st.LastUpdatedAt),
+		UpdatedBy:       st.LastUpdatedBy,
+		UsedAt:          optTime(st.LastUsedAt),
+		ExpiresAt:       optTime(st.ExparedAt),
+		InProgressFrom:  optTime(st.InProgressFrom),
+		Uses:            st.NumberOfUses,
+		Updates:         st.NumberOfUpdates,
+		Waiters:         st.Waiters,
+		Size:            st.Size,
+		Priority:        st.Priority,
+		FillSeconds:     st.FillDuration.D().Seconds(),
+		Tags:            st.Tags,
+		Meta:            st.Meta,
+	}
+
+	if st.Filled && !st.ExparedAt.IsZero() {
+		info.TTLSeconds = st.ExparedAt.Sub(now).Seconds()
+	}
+
+	return
+}
+
+// Представление всех элементов для внешних потребителей на момент получения статистики
+func (s Stats) Info() []StatInfo {
+	list := make([]StatInfo, len(s))
+	for i := range s {
+		list[i] = s[i].Info(s[i].now())
+	}
+
+	return list
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
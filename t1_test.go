@@ -1,7 +1,20 @@
 package cache
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/jsonw"
+	"github.com/alrusov/misc"
 )
 
 //----------------------------------------------------------------------------------------------------------------------------//
@@ -11,3 +24,2844 @@ func Test1(t *testing.T) {
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
+
+func TestAbort(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.Get(1, "key", "")
+	if e == nil {
+		t.Fatalf("expected new element")
+	}
+
+	var wg sync.WaitGroup
+	var retried *Elem
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		retried, _, _ = c.Get(2, "key", "")
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	e.Abort(1)
+	wg.Wait()
+
+	if retried == nil {
+		t.Fatalf("waiter must take over the fill after abort")
+	}
+
+	retried.Commit(2, "data", 200, config.Duration(time.Minute))
+	retried.Abort(2) // после Commit ничего не делает
+
+	e, data, code := c.Get(3, "key", "")
+	if e != nil || data != "data" || code != 200 {
+		t.Fatalf("unexpected result: %v, %v, %d", e, data, code)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGetWithTimeout(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.Get(1, "key", "")
+	if e == nil {
+		t.Fatalf("expected new element")
+	}
+	defer e.Abort(1)
+
+	t0 := time.Now()
+	e2, data, code := c.GetWithTimeout(2, 100*time.Millisecond, "key", "")
+	if e2 != nil || data != nil || code != CodeTimeout {
+		t.Fatalf("unexpected result: %v, %v, %d", e2, data, code)
+	}
+
+	if d := time.Since(t0); d < 100*time.Millisecond {
+		t.Fatalf("returned too early: %s", d)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestLRU(t *testing.T) {
+	c := NewWithConfig(&Config{MaxEntries: 2, Shards: 1})
+
+	fill := func(key string) {
+		e, _, _ := c.Get(0, key, "")
+		if e != nil {
+			e.Commit(0, key, 200, config.Duration(time.Minute))
+		}
+	}
+
+	fill("a")
+	fill("b")
+	fill("a") // "b" теперь самый давний
+	fill("c")
+
+	if n := c.Len(); n != 2 {
+		t.Fatalf("expected 2 elements, got %d", n)
+	}
+
+	if _, _, ok := c.Peek("b"); ok {
+		t.Fatalf(`"b" must be evicted`)
+	}
+
+	if _, _, ok := c.Peek("a"); !ok {
+		t.Fatalf(`"a" must stay`)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestLFU(t *testing.T) {
+	c := NewWithConfig(&Config{MaxEntries: 2, EvictionPolicy: EvictionLFU, Shards: 1})
+
+	fill := func(key string) {
+		e, _, _ := c.Get(0, key, "")
+		if e != nil {
+			e.Commit(0, key, 200, config.Duration(time.Minute))
+		}
+	}
+
+	fill("a")
+	fill("a")
+	fill("b")
+	fill("c") // "b" использовался реже
+
+	if _, _, ok := c.Peek("b"); ok {
+		t.Fatalf(`"b" must be evicted`)
+	}
+
+	if _, _, ok := c.Peek("a"); !ok {
+		t.Fatalf(`"a" must stay`)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGlobal(t *testing.T) {
+	old := storage.Load()
+	storage.Store(New())
+	t.Cleanup(func() { storage.Store(old) })
+
+	e, _, _ := Get(0, "global", "")
+	if e == nil {
+		t.Fatalf("expected new element")
+	}
+	e.Commit(0, "data", 200, config.Duration(time.Minute))
+
+	if data, _, ok := Peek("global"); !ok || data != "data" {
+		t.Fatalf("unexpected result: %v, %v", data, ok)
+	}
+
+	if Global() != Global() {
+		t.Fatalf("global cache must be the same")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestTyped(t *testing.T) {
+	c := New()
+	tc := NewTyped[int](c)
+
+	e, _, _, err := tc.Get(0, "key", "")
+	if err != nil || e == nil {
+		t.Fatalf("expected new element: %v", err)
+	}
+	e.Commit(0, 42, 200, config.Duration(time.Minute))
+
+	_, data, code, err := tc.Get(0, "key", "")
+	if err != nil || data != 42 || code != 200 {
+		t.Fatalf("unexpected result: %d, %d, %v", data, code, err)
+	}
+
+	_, _, _, err = NewTyped[string](c).Get(0, "key", "")
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch, got %v", err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestMetrics(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.Get(0, "key", "")
+	e.Commit(0, "data", 200, config.Duration(time.Minute))
+	c.Get(0, "key", "")
+	c.Get(0, "key", "")
+
+	m := c.Metrics()
+	if m.Created != 1 || m.Misses != 1 || m.Filled != 1 || m.Fresh != 2 {
+		t.Fatalf("unexpected metrics: %+v", m)
+	}
+
+	if r := m.HitRatio(); r < 0.66 || r > 0.67 {
+		t.Fatalf("unexpected hit ratio %f", r)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestClose(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.Get(0, "key", "")
+	e.Commit(0, "data", 200, config.Duration(time.Minute))
+
+	c.Close()
+	c.Close()
+
+	if n := c.Len(); n != 0 {
+		t.Fatalf("expected empty cache, got %d", n)
+	}
+
+	e, _, _ = c.Get(0, "key", "")
+	if e == nil {
+		t.Fatalf("closed cache must always return element for filling")
+	}
+	e.Commit(0, "data", 200, config.Duration(time.Minute))
+
+	if n := c.Len(); n != 0 {
+		t.Fatalf("closed cache must not store elements, got %d", n)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestConcurrent(t *testing.T) {
+	c := NewWithConfig(&Config{Shards: 4})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+
+			for j := 0; j < 1000; j++ {
+				key := string(rune('a' + j%10))
+				e, data, _ := c.Get(id, key, "")
+				if e != nil {
+					e.Commit(id, key, 200, config.Duration(time.Minute))
+					continue
+				}
+
+				if data != key {
+					t.Errorf("unexpected data %v for %s", data, key)
+					return
+				}
+			}
+		}(uint64(i))
+	}
+
+	wg.Wait()
+
+	if n := c.Len(); n != 10 {
+		t.Fatalf("expected 10 elements, got %d", n)
+	}
+
+	if m := c.Metrics(); m.Misses != 10 {
+		t.Fatalf("expected 10 fills, got %d", m.Misses)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestHashFunc(t *testing.T) {
+	for _, f := range []HashFunc{FNVHash, Sha512Hash} {
+		if f("key", 1, "a") != f("key", 1, "a") {
+			t.Fatalf("hash must be stable")
+		}
+
+		if f("key", 1) == f("key", 2) {
+			t.Fatalf("different extra must give different hashes")
+		}
+	}
+
+	c := NewWithConfig(&Config{HashFunc: Sha512Hash})
+	e, _, _ := c.Get(0, "key", "")
+	if e.Hash != Sha512Hash("key") {
+		t.Fatalf("unexpected hash %q", e.Hash)
+	}
+
+	e, _, _ = New().Get(0, "key", "")
+	if e.Hash != FNVHash("key") {
+		t.Fatalf("unexpected hash %q", e.Hash)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestFastHashInput(t *testing.T) {
+	if _, ok := fastHashInput("key", []any{"a", 1, uint8(2), true}); !ok {
+		t.Fatalf("fast path expected")
+	}
+
+	if _, ok := fastHashInput("key", []any{1.5}); ok {
+		t.Fatalf("fast path not expected for float")
+	}
+
+	if FNVHash("key", "1") == FNVHash("key", 1) {
+		t.Fatalf("string and int must give different hashes")
+	}
+
+	if FNVHash("ab", "c") == FNVHash("a", "bc") {
+		t.Fatalf("key and extra boundaries must be respected")
+	}
+}
+
+func TestHashExtraTypes(t *testing.T) {
+	type point struct{ X int }
+
+	extras := [][]any{
+		{1},
+		{"1"},
+		{1.0},
+		{float32(1)},
+		{nil},
+		{[]int(nil)},
+		{[]int{}},
+		{point{X: 1}},
+		{map[string]int{"X": 1}},
+		{1, 1.5},       // JSON
+		{uint(1), 1.5}, // JSON
+		{"1", 1.5},     // JSON
+	}
+
+	seen := map[string]int{}
+	for i, extra := range extras {
+		h := FNVHash("key", extra...)
+		if j, exists := seen[h]; exists {
+			t.Errorf("%#v and %#v have the same hash", extras[j], extra)
+		}
+		seen[h] = i
+	}
+
+	if FNVHash("key", int8(1), 1.5) != FNVHash("key", int64(1), 1.5) {
+		t.Errorf("signed integers of different sizes must give the same hash")
+	}
+}
+
+func BenchmarkHashInputFast(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		hashInput("some:key", []any{"param", 12345})
+	}
+}
+
+func BenchmarkHashInputJSON(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		hashInput("some:key", []any{"param", 12345, 1.5})
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGetOrSet(t *testing.T) {
+	c := New()
+
+	errFill := errors.New("fill error")
+	calls := 0
+
+	fill := func() (any, int, config.Duration, error) {
+		calls++
+		if calls == 1 {
+			return nil, 0, 0, errFill
+		}
+		return "data", 200, config.Duration(time.Minute), nil
+	}
+
+	if _, _, err := c.GetOrSet(0, "key", "", fill); err != errFill {
+		t.Fatalf("expected fill error, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		data, code, err := c.GetOrSet(0, "key", "", fill)
+		if err != nil || data != "data" || code != 200 {
+			t.Fatalf("unexpected result: %v, %d, %v", data, code, err)
+		}
+	}
+
+	if calls != 2 {
+		t.Fatalf("expected 2 fill calls, got %d", calls)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("panic expected")
+			}
+		}()
+
+		c.GetOrSet(0, "panic", "", func() (any, int, config.Duration, error) { panic("oops") })
+	}()
+
+	if n := c.Len(); n != 1 {
+		t.Fatalf("aborted element must be removed, got %d elements", n)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	c := NewWithConfig(&Config{StaleWhileRevalidate: true})
+
+	done := make(chan struct{})
+	calls := 0
+
+	fill := func() (any, int, config.Duration, error) {
+		calls++
+		if calls > 1 {
+			defer close(done)
+		}
+		return calls, 200, config.Duration(50 * time.Millisecond), nil
+	}
+
+	if data, _, _ := c.GetOrSet(0, "key", "", fill); data != 1 {
+		t.Fatalf("unexpected data %v", data)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if data, _, _ := c.GetOrSet(0, "key", "", fill); data != 1 {
+		t.Fatalf("stale data expected, got %v", data)
+	}
+
+	<-done
+	time.Sleep(10 * time.Millisecond)
+
+	if data, _, _ := c.GetOrSet(0, "key", "", fill); data != 2 {
+		t.Fatalf("refreshed data expected, got %v", data)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestRefreshAhead(t *testing.T) {
+	c := NewWithConfig(&Config{RefreshAhead: config.Duration(time.Hour)})
+
+	done := make(chan struct{})
+	calls := 0
+
+	fill := func() (any, int, config.Duration, error) {
+		calls++
+		if calls > 1 {
+			defer close(done)
+		}
+		return calls, 200, config.Duration(time.Minute), nil
+	}
+
+	c.GetOrSet(0, "key", "", fill)
+
+	// До устаревания меньше RefreshAhead - данные актуальные, обновление в фоне
+	if data, _, _ := c.GetOrSet(0, "key", "", fill); data != 1 {
+		t.Fatalf("current data expected, got %v", data)
+	}
+
+	<-done
+	time.Sleep(10 * time.Millisecond)
+
+	if data, _, ok := c.Peek("key"); !ok || data != 2 {
+		t.Fatalf("refreshed data expected, got %v", data)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestJitter(t *testing.T) {
+	lifetime := config.Duration(time.Hour)
+
+	expirations := func() (list []time.Duration) {
+		c := NewWithConfig(&Config{JitterFraction: 0.5, JitterSource: rand.NewSource(1)})
+
+		for _, key := range []string{"a", "b", "c"} {
+			e, _, _ := c.Get(0, key, "")
+			e.Commit(0, key, 200, lifetime)
+
+			d := e.ExparedAt.Sub(e.LastUpdatedAt)
+			if d > lifetime.D() || d < lifetime.D()/2 {
+				t.Fatalf("lifetime %s is out of range", d)
+			}
+
+			list = append(list, d)
+		}
+
+		return
+	}
+
+	l1 := expirations()
+	l2 := expirations()
+
+	for i := range l1 {
+		if l1[i] != l2[i] {
+			t.Fatalf("same source must give same jitter: %v != %v", l1, l2)
+		}
+	}
+}
+
+func TestJitterSeed(t *testing.T) {
+	c1 := New()
+	if c1.JitterSeed() == 0 {
+		t.Fatal("seed is not recorded")
+	}
+
+	c2 := NewWithConfig(&Config{JitterSeed: c1.JitterSeed()})
+	if c1.jitterRand.Int63() != c2.jitterRand.Int63() {
+		t.Fatal("same seed must give same sequence")
+	}
+
+	if c := NewWithConfig(&Config{JitterSource: rand.NewSource(1)}); c.JitterSeed() != 0 {
+		t.Fatal("seed with custom source")
+	}
+
+	// Как при инициализации из файла конфигурации: сначала Check
+	for _, seed := range []int64{42, 0} {
+		cfg := &Config{JitterSeed: seed}
+		if err := cfg.Check(nil); err != nil {
+			t.Fatal(err)
+		}
+		if c := NewWithConfig(cfg); c.JitterSeed() == 0 || (seed != 0 && c.JitterSeed() != seed) {
+			t.Fatalf("seed %d after Check: %d", seed, c.JitterSeed())
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestLifetimeForever(t *testing.T) {
+	c := NewWithConfig(&Config{DefaultLifetime: config.Duration(time.Millisecond)})
+
+	e, _, _ := c.Get(0, "forever", "")
+	e.Commit(0, "data", 200, LifetimeForever)
+
+	e, _, _ = c.Get(0, "default", "")
+	e.Commit(0, "data", 200, 0)
+
+	time.Sleep(10 * time.Millisecond)
+
+	if _, _, ok := c.Peek("forever"); !ok {
+		t.Fatalf(`"forever" must not expire`)
+	}
+
+	if _, _, ok := c.Peek("default"); ok {
+		t.Fatalf(`"default" must expire`)
+	}
+
+	if e, _, _ := New().Get(0, "key", ""); e != nil {
+		e.Commit(0, "data", 200, 0)
+		if !e.ExparedAt.IsZero() {
+			t.Fatalf("zero lifetime without default must mean no expiration")
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestSnapshot(t *testing.T) {
+	type value struct {
+		N int
+	}
+
+	c := New()
+
+	e, _, _ := c.Get(0, "key", "", 1)
+	e.Commit(0, value{N: 1}, 200, config.Duration(time.Hour))
+
+	e, _, _ = c.Get(0, "expired", "")
+	e.Commit(0, value{N: 2}, 200, config.Duration(time.Millisecond))
+
+	e, _, _ = c.Get(0, "forever", "")
+	e.Commit(0, value{N: 3}, 200, LifetimeForever)
+
+	c.Get(0, "in progress", "")
+
+	time.Sleep(10 * time.Millisecond)
+
+	buf := new(bytes.Buffer)
+	if n, err := c.Save(buf); err != nil || n != 3 {
+		t.Fatalf("save: %d, %v", n, err)
+	}
+
+	c2 := New()
+	n, err := c2.Load(buf,
+		func(key string, data []byte) (any, error) {
+			var v value
+			err := jsonw.Unmarshal(data, &v)
+			return v, err
+		},
+	)
+	if err != nil || n != 2 {
+		t.Fatalf("load: %d, %v", n, err)
+	}
+
+	data, code, ok := c2.Peek("key", 1)
+	if !ok || data != (value{N: 1}) || code != 200 {
+		t.Fatalf("unexpected result: %v, %d, %v", data, code, ok)
+	}
+
+	if _, _, ok := c2.Peek("forever"); !ok {
+		t.Fatalf(`"forever" must be loaded`)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestTouch(t *testing.T) {
+	c := New()
+
+	if c.Touch(config.Duration(time.Hour), "key") {
+		t.Fatalf("touch of absent element must fail")
+	}
+
+	e, _, _ := c.Get(0, "key", "")
+	if c.Touch(config.Duration(time.Hour), "key") {
+		t.Fatalf("touch of element in progress must fail")
+	}
+
+	e.Commit(0, "data", 200, config.Duration(time.Millisecond))
+	if !c.Touch(config.Duration(time.Hour), "key") {
+		t.Fatalf("touch failed")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if _, _, ok := c.Peek("key"); !ok {
+		t.Fatalf("touched element must be fresh")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestInvalidateTag(t *testing.T) {
+	c := NewWithConfig(&Config{Shards: 4})
+
+	for i, tags := range [][]string{{"user:1"}, {"user:1", "user:2"}, {"user:2"}, nil} {
+		e, _, _ := c.Get(0, "key", "", i)
+		e.CommitEx(0, i, 200, config.Duration(time.Hour), &CommitOptions{Tags: tags})
+	}
+
+	if n := c.InvalidateTag("user:1"); n != 2 {
+		t.Fatalf("expected 2 removed, got %d", n)
+	}
+
+	if n := c.InvalidateTag("user:1"); n != 0 {
+		t.Fatalf("expected 0 removed, got %d", n)
+	}
+
+	if n := c.InvalidateTag("user:2"); n != 1 {
+		t.Fatalf("expected 1 removed, got %d", n)
+	}
+
+	if n := c.Len(); n != 1 {
+		t.Fatalf("expected 1 element, got %d", n)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestDeleteByKeyPrefix(t *testing.T) {
+	c := New()
+
+	for _, key := range []string{"user:1:a", "user:1:b", "user:12:a", "user:2:a"} {
+		e, _, _ := c.Get(0, key, "")
+		e.Commit(0, key, 200, 0)
+	}
+
+	if n := c.DeleteByKeyPrefix("user:1:"); n != 2 {
+		t.Fatalf("expected 2 removed, got %d", n)
+	}
+
+	if n := c.Len(); n != 2 {
+		t.Fatalf("expected 2 elements, got %d", n)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestOnEvict(t *testing.T) {
+	var c *Cache
+	var evicted []string
+
+	c = NewWithConfig(&Config{
+		MaxEntries: 1,
+		Shards:     1,
+		OnEvict: func(key string, data any) {
+			c.Len() // блокировка уже снята
+			evicted = append(evicted, key)
+		},
+	})
+
+	for _, key := range []string{"a", "b"} {
+		e, _, _ := c.Get(0, key, "")
+		e.Commit(0, key, 200, 0)
+	}
+
+	c.Delete("b")
+	c.Delete("b")
+
+	if len(evicted) != 2 || evicted[0] != "a" || evicted[1] != "b" {
+		t.Fatalf("unexpected evicted %v", evicted)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestOnCommit(t *testing.T) {
+	var c *Cache
+	var commits []Stat
+
+	c = NewWithConfig(&Config{
+		OnCommit: func(st Stat, data any) {
+			c.Peek("a") // блокировка уже снята
+			if data != st.Code {
+				t.Errorf("unexpected data %v", data)
+			}
+			commits = append(commits, st)
+		},
+	})
+
+	for i := 1; i <= 2; i++ {
+		e, _, _ := c.Get(0, "a", "")
+		e.Commit(0, i, i, LifetimeForever)
+		c.Delete("a")
+	}
+
+	if len(commits) != 2 || commits[0].Code != 1 || commits[1].Code != 2 || !commits[1].Filled {
+		t.Fatalf("unexpected commits %v", commits)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestMaxBytes(t *testing.T) {
+	c := NewWithConfig(&Config{MaxBytes: 100, Shards: 1})
+
+	commit := func(key string, size int64, lifetime time.Duration) {
+		e, _, _ := c.Get(0, key, "")
+		e.CommitEx(0, key, 200, config.Duration(lifetime), &CommitOptions{Size: size})
+	}
+
+	commit("a", 40, time.Millisecond)
+	commit("b", 40, time.Hour)
+	time.Sleep(2 * time.Millisecond)
+	commit("a", 30, time.Hour) // обновление меняет размер, "a" становится последним использованным
+
+	if n := c.TotalBytes(); n != 70 {
+		t.Fatalf("expected 70 bytes, got %d", n)
+	}
+
+	commit("c", 50, time.Hour) // вытесняется "b"
+
+	if _, _, ok := c.Peek("b"); ok {
+		t.Fatal("b should be evicted")
+	}
+
+	if n := c.TotalBytes(); n != 80 {
+		t.Fatalf("expected 80 bytes, got %d", n)
+	}
+
+	c.Delete("a")
+	commit("d", 200, time.Hour) // не помещается сам
+
+	if n, l := c.TotalBytes(), c.Len(); n != 0 || l != 0 {
+		t.Fatalf("expected empty cache, got %d bytes, %d elements", n, l)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGetContext(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.Get(0, "a", "")
+	defer e.Abort(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	e2, data, code, err := c.GetContext(ctx, 0, "a", "")
+	if e2 != nil || data != nil || code != CodeCanceled || !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected result %v, %v, %d, %v", e2, data, code, err)
+	}
+
+	_, _, code, err = c.GetContext(ctx, 0, "a", "")
+	if code != CodeCanceled || err == nil {
+		t.Fatalf("expected immediate cancel, got %d, %v", code, err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestErrors(t *testing.T) {
+	c := New()
+
+	if _, _, _, err := c.GetContext(context.Background(), 0, "a", "", func() {}); !errors.Is(err, ErrHash) {
+		t.Fatalf("expected ErrHash, got %v", err)
+	}
+
+	e, _, _, err := c.GetContext(context.Background(), 0, "a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = e.Commit(0, 1, 200, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = e.Commit(0, 2, 200, 0); !errors.Is(err, ErrNotInProgress) {
+		t.Fatalf("expected ErrNotInProgress, got %v", err)
+	}
+
+	if data, _, _ := c.Peek("a"); data != 1 {
+		t.Fatalf("repeated commit should be ignored, got %v", data)
+	}
+
+	if m := c.Metrics(); m.Filled != 1 {
+		t.Fatalf("expected 1 filled, got %d", m.Filled)
+	}
+
+	c.Close()
+
+	e, _, _, err = c.GetContext(context.Background(), 0, "b", "")
+	if e == nil || !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected element and ErrClosed, got %v, %v", e, err)
+	}
+
+	if err = e.Commit(0, 1, 200, 0); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestRecover(t *testing.T) {
+	c := New()
+
+	func() {
+		e, _, _ := c.Get(0, "a", "")
+		defer e.Recover(0)
+		panic("test")
+	}()
+
+	e, _, _ := c.GetWithTimeout(0, time.Second, "a", "")
+	if e == nil {
+		t.Fatal("expected element to fill after recovered panic")
+	}
+	defer e.Recover(0)
+
+	e.Commit(0, 1, 200, 0)
+
+	if data, _, ok := c.Peek("a"); !ok || data != 1 {
+		t.Fatalf("unexpected %v, %v", data, ok)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestInProgressCount(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.Get(0, "a", "")
+
+	done := make(chan struct{})
+	go func() {
+		c.Get(0, "a", "")
+		close(done)
+	}()
+
+	for i := 0; ; i++ {
+		if st := c.GetStat(); len(st) == 1 && st[0].Waiters == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("waiter not found")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := c.InProgressCount(); n != 1 {
+		t.Fatalf("expected 1 in progress, got %d", n)
+	}
+
+	e.Commit(0, 1, 200, 0)
+	<-done
+
+	if n := c.InProgressCount(); n != 0 {
+		t.Fatalf("expected 0 in progress, got %d", n)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGetStatWithData(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, "data", 200, 0)
+
+	if st := c.GetStat(); len(st) != 1 || st[0].Data != nil {
+		t.Fatalf("unexpected stat %v", st)
+	}
+
+	if st := c.GetStatWithData(); len(st) != 1 || st[0].Data != "data" {
+		t.Fatalf("unexpected stat %v", st)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGetStatSorted(t *testing.T) {
+	c := New()
+
+	for i, key := range []string{"b", "a", "c"} {
+		e, _, _ := c.Get(0, key, "")
+		e.Commit(0, key, 200, 0)
+
+		for j := 0; j < i; j++ {
+			c.Get(0, key, "")
+		}
+	}
+
+	keys := func(s Stats) (k string) {
+		for _, st := range s {
+			k += st.Key
+		}
+		return
+	}
+
+	if k := keys(c.GetStatSorted(SortByNumberOfUses, true)); k != "cab" {
+		t.Fatalf("unexpected order %s", k)
+	}
+
+	if k := keys(c.GetStatSorted(SortByNumberOfUses, false)); k != "bac" {
+		t.Fatalf("unexpected order %s", k)
+	}
+
+	if k := keys(c.GetStatSorted(SortByKey, true)); k != "cba" {
+		t.Fatalf("unexpected order %s", k)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGetStatFiltered(t *testing.T) {
+	c := New()
+
+	for _, key := range []string{"user:1", "user:2", "item:1"} {
+		e, _, _ := c.Get(0, key, "")
+		e.Commit(0, key, 200, 0)
+	}
+
+	e, _, _ := c.Get(0, "user:3", "")
+	defer e.Abort(0)
+
+	if s := c.GetStatFiltered(FilterKeyPrefix("user:")); len(s) != 3 {
+		t.Fatalf("expected 3 elements, got %d", len(s))
+	}
+
+	if s := c.GetStatFiltered(FilterInProgress()); len(s) != 1 || s[0].Key != "user:3" {
+		t.Fatalf("unexpected %v", s)
+	}
+
+	if s := c.GetStatFiltered(FilterExpired()); len(s) != 0 {
+		t.Fatalf("expected no expired elements, got %d", len(s))
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestResetStats(t *testing.T) {
+	c := New()
+
+	for _, key := range []string{"a", "b"} {
+		e, _, _ := c.Get(0, key, "")
+		e.Commit(0, key, 200, 0)
+		c.Get(0, key, "")
+	}
+
+	if !c.ResetStat("a") || c.ResetStat("c") {
+		t.Fatal("unexpected ResetStat result")
+	}
+
+	s := c.GetStat()
+	if s[0].NumberOfUses != 0 || s[0].NumberOfUpdates != 0 || s[1].NumberOfUses != 2 || s[1].NumberOfUpdates != 1 {
+		t.Fatalf("unexpected stat %+v", s)
+	}
+
+	c.ResetStats()
+
+	for _, st := range c.GetStat() {
+		if st.NumberOfUses != 0 || st.NumberOfUpdates != 0 {
+			t.Fatalf("unexpected stat %+v", st)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestForEach(t *testing.T) {
+	c := New()
+
+	for _, key := range []string{"a", "b", "c"} {
+		e, _, _ := c.Get(0, key, "")
+		e.Commit(0, key, 200, 0)
+	}
+
+	n := 0
+	c.ForEach(func(st Stat, data any) bool {
+		if data != st.Key {
+			t.Errorf("unexpected data %v for %s", data, st.Key)
+		}
+		n++
+		return true
+	})
+
+	if n != 3 {
+		t.Fatalf("expected 3 elements, got %d", n)
+	}
+
+	n = 0
+	c.ForEach(func(st Stat, data any) bool {
+		n++
+		return false
+	})
+
+	if n != 1 {
+		t.Fatalf("expected to stop after 1 element, got %d", n)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestNegative(t *testing.T) {
+	c := NewWithConfig(&Config{
+		DefaultLifetime:      config.Duration(time.Hour),
+		NegativeLifetime:     config.Duration(20 * time.Millisecond),
+		StaleWhileRevalidate: true,
+	})
+
+	e, _, _ := c.Get(0, "key", "")
+	e.CommitEx(0, nil, 404, 0, &CommitOptions{Negative: true})
+
+	if s := c.GetStat(); !s[0].Negative || s[0].Lifetime != config.Duration(20*time.Millisecond) {
+		t.Fatalf("unexpected stat %+v", s[0])
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	// Устаревший отрицательный результат не отдаётся, заполнение синхронное
+	data, code, err := c.GetOrSet(0, "key", "", func() (any, int, config.Duration, error) {
+		return "found", 200, 0, nil
+	})
+	if err != nil || data != "found" || code != 200 {
+		t.Fatalf("unexpected %v, %d, %v", data, code, err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestRegistry(t *testing.T) {
+	t.Cleanup(func() {
+		UnregisterCache("test-a")
+		UnregisterCache("test-b")
+	})
+
+	a := GetCache("test-a")
+	if GetCache("test-a") != a {
+		t.Fatal("expected the same cache")
+	}
+
+	b := New()
+	if old := RegisterCache("test-b", b); old != nil {
+		t.Fatal("unexpected old cache")
+	}
+
+	e, _, _ := b.Get(0, "key", "")
+	e.Commit(0, 1, 200, 0)
+
+	all := AllStats()
+	if len(all["test-a"]) != 0 || len(all["test-b"]) != 1 {
+		t.Fatalf("unexpected stats %v", all)
+	}
+
+	if old := RegisterCache("test-c", nil); old != nil {
+		t.Fatal("unexpected old cache")
+	}
+	if _, exists := AllStats()["test-c"]; exists {
+		t.Fatal("nil must not be registered")
+	}
+
+	if UnregisterCache("test-b") != b || UnregisterCache("test-b") != nil {
+		t.Fatal("unregister failed")
+	}
+	if _, exists := AllStats()["test-b"]; exists {
+		t.Fatal("test-b is still registered")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCollision(t *testing.T) {
+	c := NewWithConfig(&Config{
+		HashFunc: func(key string, extra ...any) string { return "same" },
+	})
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, "a", 200, 0)
+
+	e, data, _ := c.Get(0, "b", "")
+	if e == nil || data != nil {
+		t.Fatalf("expected element to fill, got %v", data)
+	}
+	e.Commit(0, "b", 200, 0)
+
+	if data, _, ok := c.Peek("a"); !ok || data != "a" {
+		t.Fatalf("unexpected %v, %v", data, ok)
+	}
+
+	if _, _, ok := c.Peek("b"); ok {
+		t.Fatal("b should not be stored")
+	}
+
+	if m := c.Metrics(); m.Collisions != 1 {
+		t.Fatalf("expected 1 collision, got %d", m.Collisions)
+	}
+
+	if c.Touch(LifetimeForever, "b") || c.ResetStat("b") || c.Delete("b") {
+		t.Fatal("b must not match a")
+	}
+
+	if _, _, ok := c.Peek("a"); !ok {
+		t.Fatal("a must stay")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGCRetentionFactor(t *testing.T) {
+	for _, df := range []struct {
+		factor  float64
+		retired time.Duration
+	}{
+		{0, 2 * time.Minute}, // по умолчанию
+		{1, time.Minute},
+		{3, 3 * time.Minute},
+	} {
+		c := NewWithConfig(&Config{GCRetentionFactor: df.factor})
+
+		e, _, _ := c.Get(0, "a", "")
+		e.Commit(0, 1, 200, config.Duration(time.Minute))
+
+		if c.retired(e, e.LastUpdatedAt.Add(df.retired-time.Second)) || !c.retired(e, e.LastUpdatedAt.Add(df.retired)) {
+			t.Fatalf("factor %g: unexpected retirement", df.factor)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestBatchGet(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.Get(0, "hit", "")
+	e.Commit(0, "hit", 200, 0)
+
+	busy, _, _ := c.Get(0, "busy", "")
+	defer busy.Abort(0)
+
+	r := c.BatchGet(0, []KeySpec{{Key: "hit"}, {Key: "miss", Extra: []any{1}}, {Key: "busy"}})
+
+	if r[0].Elem != nil || r[0].Data != "hit" || r[0].Code != 200 {
+		t.Fatalf("unexpected hit %+v", r[0])
+	}
+
+	if r[1].Elem == nil {
+		t.Fatalf("expected miss %+v", r[1])
+	}
+	r[1].Elem.Commit(0, "miss", 200, 0)
+
+	if r[2].Elem != nil || r[2].Code != CodeInProgress {
+		t.Fatalf("expected in progress %+v", r[2])
+	}
+
+	if data, _, ok := c.Peek("miss", 1); !ok || data != "miss" {
+		t.Fatalf("unexpected %v, %v", data, ok)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestMeta(t *testing.T) {
+	c := New()
+
+	meta := map[string]string{"source": "db"}
+
+	e, _, _ := c.Get(0, "a", "", 1)
+	e.CommitEx(0, 1, 200, config.Duration(time.Millisecond), &CommitOptions{Meta: meta})
+	meta["source"] = "changed"
+
+	if s := c.GetStat(); s[0].Meta["source"] != "db" {
+		t.Fatalf("unexpected meta %v", s[0].Meta)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	e, _, _ = c.Get(0, "a", "", 1)
+	e.CommitEx(0, 1, 200, 0, &CommitOptions{Meta: map[string]string{}})
+
+	if s := c.GetStat(); s[0].Meta != nil {
+		t.Fatalf("expected no meta, got %v", s[0].Meta)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCommitIfChanged(t *testing.T) {
+	c := New()
+
+	commit := func(data any, contentHash string) bool {
+		e, _, _ := c.Get(0, "a", "")
+		if e == nil {
+			t.Fatal("expected element to fill")
+		}
+
+		changed, err := e.CommitIfChanged(0, data, 200, config.Duration(time.Millisecond), contentHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(2 * time.Millisecond)
+		return changed
+	}
+
+	if !commit("v1", "h1") {
+		t.Fatal("first commit should change data")
+	}
+
+	if commit("v1 again", "h1") {
+		t.Fatal("same content hash should not change data")
+	}
+
+	if s := c.GetStatWithData(); s[0].Data != "v1" || s[0].NumberOfUpdates != 1 {
+		t.Fatalf("unexpected stat %+v", s[0])
+	}
+
+	if !commit("v2", "h2") {
+		t.Fatal("new content hash should change data")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestMaxLifetime(t *testing.T) {
+	c := NewWithConfig(&Config{MaxLifetime: config.Duration(time.Minute)})
+
+	for i, lifetime := range []config.Duration{config.Duration(time.Second), config.Duration(time.Hour), LifetimeForever} {
+		e, _, _ := c.Get(0, "key", "", i)
+		e.Commit(0, i, 200, lifetime)
+	}
+
+	expected := []time.Duration{time.Second, time.Minute, time.Minute}
+	for _, st := range c.GetStatWithData() {
+		if d := st.Lifetime.D(); d != expected[st.Data.(int)] {
+			t.Fatalf("%v: unexpected lifetime %s", st.Data, d)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestStatsTotals(t *testing.T) {
+	c := New()
+
+	for i, lifetime := range []time.Duration{time.Millisecond, time.Hour} {
+		e, _, _ := c.Get(0, "key", "", i)
+		e.Commit(0, i, 200, config.Duration(lifetime))
+	}
+
+	c.Get(0, "key", "", 1)
+	c.Get(0, "key", "", 1)
+	time.Sleep(2 * time.Millisecond)
+
+	s := c.GetStat()
+	if s.Count() != 2 || s.TotalUses() != 4 || s.TotalUpdates() != 2 || s.Expired() != 1 {
+		t.Fatalf("unexpected totals %d, %d, %d, %d", s.Count(), s.TotalUses(), s.TotalUpdates(), s.Expired())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestClock(t *testing.T) {
+	c := New()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, config.Duration(time.Minute))
+
+	now = now.Add(59 * time.Second)
+	if _, _, ok := c.Peek("a"); !ok {
+		t.Fatal("expected fresh data")
+	}
+
+	now = now.Add(time.Second)
+	if _, _, ok := c.Peek("a"); ok {
+		t.Fatal("expected expired data")
+	}
+
+	if e, _, _ := c.Get(0, "a", ""); e == nil {
+		t.Fatal("expected element to refill")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestTryGet(t *testing.T) {
+	c := New()
+
+	if _, _, _, ok := c.TryGet("a"); ok || c.Len() != 0 {
+		t.Fatal("miss should not create an element")
+	}
+
+	e, _, _ := c.Get(0, "a", "")
+
+	if _, _, _, ok := c.TryGet("a"); ok {
+		t.Fatal("unfilled element should not be returned")
+	}
+
+	e.Commit(0, 1, 200, 0)
+
+	if data, code, stale, ok := c.TryGet("a"); !ok || stale || data != 1 || code != 200 {
+		t.Fatalf("unexpected %v, %d, %v, %v", data, code, stale, ok)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestMaxConcurrentFills(t *testing.T) {
+	c := NewWithConfig(&Config{MaxConcurrentFills: 1})
+
+	e, _, _ := c.Get(0, "a", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if e2, _, code, _ := c.GetContext(ctx, 0, "b", ""); e2 != nil || code != CodeCanceled {
+		t.Fatalf("expected to be canceled waiting for a fill slot, got %v, %d", e2, code)
+	}
+
+	if c.Len() != 1 {
+		t.Fatalf("canceled element should be removed, got %d elements", c.Len())
+	}
+
+	done := make(chan *Elem)
+	go func() {
+		e2, _, _ := c.Get(0, "b", "")
+		done <- e2
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("second fill should wait")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	e.Commit(0, 1, 200, 0)
+
+	e2 := <-done
+	if e2 == nil {
+		t.Fatal("expected element to fill")
+	}
+	e2.Abort(0)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestLogFacility(t *testing.T) {
+	if c := New(); c.log != Log {
+		t.Fatal("expected package log facility by default")
+	}
+
+	if c := NewWithConfig(&Config{LogName: "cache-test"}); c.log == Log || c.log == nil {
+		t.Fatal("expected own log facility")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestPriority(t *testing.T) {
+	for _, policy := range []EvictionPolicy{EvictionLRU, EvictionLFU} {
+		c := NewWithConfig(&Config{MaxEntries: 2, EvictionPolicy: policy, Shards: 1})
+
+		e, _, _ := c.Get(0, "important", "")
+		e.CommitEx(0, 1, 200, 0, &CommitOptions{Priority: 10})
+
+		e, _, _ = c.Get(0, "b", "")
+		e.Commit(0, 2, 200, 0)
+		c.Get(0, "b", "")
+
+		e, _, _ = c.Get(0, "c", "")
+		e.Commit(0, 3, 200, 0)
+
+		if _, _, ok := c.Peek("important"); !ok {
+			t.Fatalf("%s: high priority element should survive", policy)
+		}
+
+		if _, _, ok := c.Peek("b"); ok {
+			t.Fatalf("%s: b should be evicted", policy)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type testBackend struct {
+	sync.Mutex
+	data map[string]any
+}
+
+func (b *testBackend) Load(hash string) (data any, code int, ttl time.Duration, ok bool, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	data, ok = b.data[hash]
+	return data, 200, time.Hour, ok, nil
+}
+
+func (b *testBackend) Store(hash string, data any, code int, ttl time.Duration) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.data[hash] = data
+	return nil
+}
+
+func TestBackend(t *testing.T) {
+	b := &testBackend{data: map[string]any{}}
+
+	c1 := NewWithConfig(&Config{Backend: b})
+	e, _, _ := c1.Get(0, "a", "")
+	e.Commit(0, "shared", 200, 0)
+
+	if len(b.data) != 1 {
+		t.Fatalf("expected write-through, got %v", b.data)
+	}
+
+	c2 := NewWithConfig(&Config{Backend: b})
+	e, data, code := c2.Get(0, "a", "")
+	if e != nil || data != "shared" || code != 200 {
+		t.Fatalf("expected backend hit, got %v, %v, %d", e, data, code)
+	}
+
+	if data, _, ok := c2.Peek("a"); !ok || data != "shared" {
+		t.Fatal("backend hit should be stored in memory")
+	}
+
+	c3 := NewWithConfig(&Config{Backend: b})
+	r := c3.BatchGet(0, []KeySpec{{Key: "a"}, {Key: "b"}})
+	if r[0].Elem != nil || r[0].Data != "shared" || r[0].Code != 200 {
+		t.Fatalf("expected backend hit in BatchGet, got %+v", r[0])
+	}
+	if r[1].Elem == nil {
+		t.Fatal("expected element to fill")
+	}
+	r[1].Elem.Abort(0)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestInvalidation(t *testing.T) {
+	var c1, c2 *Cache
+	published := 0
+
+	c2 = New()
+	c1 = NewWithConfig(&Config{
+		OnInvalidate: func(hashes []string, tags []string) {
+			published++
+			c2.ApplyInvalidation(hashes, tags...)
+		},
+	})
+
+	for _, c := range []*Cache{c1, c2} {
+		for _, key := range []string{"a", "b", "c"} {
+			e, _, _ := c.Get(0, key, "")
+			e.CommitEx(0, key, 200, 0, &CommitOptions{Tags: []string{"tag-" + key}})
+		}
+	}
+
+	c1.Delete("a")
+	c1.InvalidateTag("tag-b")
+
+	if published != 2 || c1.Len() != 1 || c2.Len() != 1 {
+		t.Fatalf("unexpected %d, %d, %d", published, c1.Len(), c2.Len())
+	}
+
+	if _, _, ok := c2.Peek("c"); !ok {
+		t.Fatal("c should stay")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestPreload(t *testing.T) {
+	c := New()
+
+	busy, _, _ := c.Get(0, "busy", "")
+	defer busy.Abort(0)
+
+	n := c.Preload([]PreloadSpec{
+		{Key: "a", Data: 1, Code: 200},
+		{Key: "b", Extra: []any{1}, Data: 2, Code: 200, Options: &CommitOptions{Tags: []string{"t"}}},
+		{Key: "busy", Data: 3, Code: 200},
+	})
+	if n != 2 {
+		t.Fatalf("expected 2 preloaded, got %d", n)
+	}
+
+	if data, _, ok := c.Peek("b", 1); !ok || data != 2 {
+		t.Fatalf("unexpected %v, %v", data, ok)
+	}
+
+	if e, data, _ := c.Get(0, "a", ""); e != nil || data != 1 {
+		t.Fatalf("expected hit, got %v, %v", e, data)
+	}
+
+	if c.InvalidateTag("t") != 1 {
+		t.Fatal("preloaded tags expected")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestTTL(t *testing.T) {
+	c := New()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	if _, _, ok := c.TTL("a"); ok {
+		t.Fatal("expected absent")
+	}
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, config.Duration(time.Minute))
+
+	e, _, _ = c.Get(0, "b", "")
+	e.Commit(0, 1, 200, LifetimeForever)
+
+	now = now.Add(90 * time.Second)
+
+	if ttl, forever, ok := c.TTL("a"); !ok || forever || ttl != -30*time.Second {
+		t.Fatalf("unexpected %s, %v, %v", ttl, forever, ok)
+	}
+
+	if ttl, forever, ok := c.TTL("b"); !ok || !forever || ttl != 0 {
+		t.Fatalf("unexpected %s, %v, %v", ttl, forever, ok)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGetByHash(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.GetByHash(0, "my-hash", "a", "")
+	e.Commit(0, 1, 200, 0)
+
+	if e, data, _ := c.GetByHash(0, "my-hash", "a", ""); e != nil || data != 1 {
+		t.Fatalf("expected hit, got %v, %v", e, data)
+	}
+
+	if s := c.GetStat(); s[0].Hash != "my-hash" || s[0].Key != "a" {
+		t.Fatalf("unexpected stat %+v", s[0])
+	}
+
+	// Готовый hash, совпадающий с вычисляемым, находит тот же элемент
+	e, _, _ = c.Get(0, "b", "")
+	e.Commit(0, 2, 200, 0)
+
+	if _, data, _ := c.GetByHash(0, FNVHash("b"), "b", ""); data != 2 {
+		t.Fatalf("expected the same element, got %v", data)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCompact(t *testing.T) {
+	c := NewWithConfig(&Config{InitialCapacity: 1, Shards: 1})
+
+	for i := 0; i < 100; i++ {
+		e, _, _ := c.Get(0, "key", "", i)
+		e.Commit(0, i, 200, 0)
+	}
+
+	if n := c.Compact(); n != 0 {
+		t.Fatalf("nothing to compact, got %d", n)
+	}
+
+	for i := 0; i < 90; i++ {
+		c.Delete("key", i)
+	}
+
+	if n := c.Compact(); n != 1 {
+		t.Fatalf("expected 1 compacted shard, got %d", n)
+	}
+
+	for i := 90; i < 100; i++ {
+		if data, _, ok := c.Peek("key", i); !ok || data != i {
+			t.Fatalf("%d: unexpected %v, %v", i, data, ok)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestStatInfo(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, config.Duration(time.Minute))
+
+	info := c.GetStat().Info()
+	if len(info) != 1 || info[0].Key != "a" || info[0].Expired || info[0].TTLSeconds <= 0 || info[0].ExpiresAt == nil {
+		t.Fatalf("unexpected %+v", info)
+	}
+
+	j, err := jsonw.Marshal(info[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(j, []byte(`"ttlSeconds":`)) || bytes.Contains(j, []byte(`"inProgressFrom"`)) {
+		t.Fatalf("unexpected json %s", j)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestSetDefaultLifetime(t *testing.T) {
+	c := New()
+	c.SetDefaultLifetime("user:", config.Duration(time.Hour))
+	c.SetDefaultLifetime("user:admin:", config.Duration(2*time.Hour))
+
+	cases := []struct {
+		key      string
+		lifetime config.Duration
+		expected config.Duration
+	}{
+		{"user:1", 0, config.Duration(time.Hour)},
+		{"user:admin:1", 0, config.Duration(2 * time.Hour)},
+		{"user:2", config.Duration(time.Minute), config.Duration(time.Minute)},
+		{"other", 0, c.defaultLifetime},
+	}
+
+	for _, cs := range cases {
+		e, _, _ := c.Get(0, cs.key, "")
+		e.Commit(0, 1, 200, cs.lifetime)
+		if e.Lifetime != cs.expected {
+			t.Errorf("%s: got %s, expected %s", cs.key, e.Lifetime.D(), cs.expected.D())
+		}
+	}
+
+	c.SetDefaultLifetime("user:", 0)
+	if l := c.lifetime("user:3", 200, 0, false); l != c.defaultLifetime {
+		t.Errorf("got %s after removal", l.D())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestDeleteExpired(t *testing.T) {
+	c := NewWithConfig(&Config{GCRetentionFactor: 1})
+
+	now := misc.NowUTC()
+	c.now = func() time.Time { return now }
+
+	e, _, _ := c.Get(0, "old", "")
+	e.Commit(0, 1, 200, config.Duration(time.Minute))
+
+	e, _, _ = c.Get(0, "new", "")
+	e.Commit(0, 1, 200, config.Duration(time.Hour))
+
+	busy, _, _ := c.Get(0, "busy", "")
+	defer busy.Abort(0)
+
+	now = now.Add(2 * time.Minute)
+
+	if n := c.DeleteExpired(); n != 1 || c.Len() != 2 {
+		t.Fatalf("removed %d, left %d", n, c.Len())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestOnStaleHit(t *testing.T) {
+	var c *Cache
+	var hits []string
+
+	c = NewWithConfig(&Config{
+		OnStaleHit: func(key string) {
+			c.Peek(key) // блокировка уже снята
+			hits = append(hits, key)
+		},
+	})
+
+	now := misc.NowUTC()
+	c.now = func() time.Time { return now }
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, config.Duration(time.Minute))
+
+	c.Get(0, "a", "") // актуальные
+	if len(hits) != 0 {
+		t.Fatalf("unexpected hits %v", hits)
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	e, _, _ = c.Get(0, "a", "") // на обновление
+	defer e.Abort(0)
+
+	if _, data, _ := c.Get(0, "a", ""); data != 1 || len(hits) != 1 || hits[0] != "a" {
+		t.Fatalf("unexpected data %v, hits %v", data, hits)
+	}
+
+	if data, _, stale, ok := c.TryGet("a"); !ok || !stale || data != 1 || len(hits) != 2 {
+		t.Fatalf("TryGet: data %v, hits %v", data, hits)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestClone(t *testing.T) {
+	c := NewWithConfig(&Config{
+		Clone: func(data any) any {
+			return append([]int(nil), data.([]int)...)
+		},
+	})
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, []int{1, 2}, 200, 0)
+
+	_, data, _ := c.Get(0, "a", "")
+	data.([]int)[0] = 100
+
+	if data, _, _ := c.Peek("a"); data.([]int)[0] != 1 {
+		t.Fatalf("cached data changed: %v", data)
+	}
+
+	c.GetStatWithData()[0].Data.([]int)[0] = 100
+	c.ForEach(func(st Stat, data any) bool {
+		data.([]int)[1] = 100
+		return true
+	})
+
+	if data, _, _ := c.Peek("a"); data.([]int)[0] != 1 || data.([]int)[1] != 2 {
+		t.Fatalf("cached data changed through stats: %v", data)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestWaitFilled(t *testing.T) {
+	c := New()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.WaitFilled(context.Background(), "a")
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	e, _, _ := c.Get(0, "a", "")
+
+	select {
+	case err := <-done:
+		t.Fatalf("returned before commit: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	e.Commit(0, 1, 200, 0)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := c.WaitFilled(ctx, "b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected %v", err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGetMaxAge(t *testing.T) {
+	c := New()
+
+	now := misc.NowUTC()
+	c.now = func() time.Time { return now }
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, config.Duration(time.Hour))
+
+	now = now.Add(10 * time.Minute)
+
+	if e, data, _ := c.GetMaxAge(0, time.Hour, "a", ""); e != nil || data != 1 {
+		t.Fatalf("expected data, got %v", data)
+	}
+
+	e, _, _ = c.GetMaxAge(0, 5*time.Minute, "a", "")
+	if e == nil {
+		t.Fatal("expected elem for refill")
+	}
+
+	if _, data, _ := c.Get(0, "a", ""); data != 1 {
+		t.Fatalf("unexpected %v", data)
+	}
+
+	e.Commit(0, 2, 200, config.Duration(time.Hour))
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestFillDuration(t *testing.T) {
+	c := New()
+
+	now := misc.NowUTC()
+	c.now = func() time.Time { return now }
+
+	e, _, _ := c.Get(0, "a", "")
+	now = now.Add(3 * time.Second)
+	e.Commit(0, 1, 200, 0)
+
+	if e.FillDuration.D() != 3*time.Second {
+		t.Fatalf("unexpected %s", e.FillDuration.D())
+	}
+
+	if m := c.Metrics(); m.FillTime != 3*time.Second || m.AvgFillTime() != 3*time.Second {
+		t.Fatalf("unexpected %+v", m)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestDeleteInProgress(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.Get(0, "a", "")
+
+	done := make(chan int, 1)
+	go func() {
+		_, _, code := c.Get(0, "a", "")
+		done <- code
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	c.Delete("a")
+
+	if code := <-done; code != CodeDeleted {
+		t.Fatalf("unexpected code %d", code)
+	}
+
+	if err := e.Commit(0, 1, 200, 0); !errors.Is(err, ErrDeleted) {
+		t.Fatalf("unexpected %v", err)
+	}
+
+	if _, _, ok := c.Peek("a"); ok || c.Len() != 0 {
+		t.Fatal("deleted element resurrected")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestKeys(t *testing.T) {
+	c := New()
+
+	for _, k := range []KeySpec{{Key: "b"}, {Key: "a", Extra: []any{1}}, {Key: "a", Extra: []any{2}}} {
+		e, _, _ := c.Get(0, k.Key, "", k.Extra...)
+		e.Commit(0, 1, 200, 0)
+	}
+
+	if keys := c.Keys(); len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatalf("unexpected %v", keys)
+	}
+
+	if hashes := c.Hashes(); len(hashes) != 3 {
+		t.Fatalf("unexpected %v", hashes)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestLifetimePolicy(t *testing.T) {
+	c := NewWithConfig(&Config{
+		LifetimePolicy: func(code int) config.Duration {
+			if code >= 400 {
+				return config.Duration(time.Second)
+			}
+			return 0
+		},
+	})
+
+	for _, df := range []struct {
+		code     int
+		lifetime config.Duration
+		expected config.Duration
+	}{
+		{500, 0, config.Duration(time.Second)},
+		{500, config.Duration(time.Hour), config.Duration(time.Hour)},
+		{200, 0, c.defaultLifetime},
+	} {
+		e, _, _ := c.Get(0, "a", "", df.code, df.lifetime)
+		e.Commit(0, 1, df.code, df.lifetime)
+		if e.Lifetime != df.expected {
+			t.Errorf("code %d: got %s, expected %s", df.code, e.Lifetime.D(), df.expected.D())
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestDedup(t *testing.T) {
+	c := NewWithConfig(&Config{Dedup: true})
+
+	for _, key := range []string{"a", "b"} {
+		e, _, _ := c.Get(0, key, "")
+		e.CommitEx(0, &[]int{1}, 200, 0, &CommitOptions{ContentHash: "h1"})
+	}
+
+	a, _, _ := c.Peek("a")
+	b, _, _ := c.Peek("b")
+	if a.(*[]int) != b.(*[]int) {
+		t.Fatal("data is not shared")
+	}
+
+	c.Delete("a")
+	c.Delete("b")
+	if len(c.dedup) != 0 {
+		t.Fatalf("dedup leaked %v", c.dedup)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestLifetimeMultiplier(t *testing.T) {
+	c := New()
+	c.SetLifetimeMultiplier(0.5)
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, config.Duration(time.Hour))
+	if e.Lifetime.D() != 30*time.Minute {
+		t.Fatalf("unexpected %s", e.Lifetime.D())
+	}
+
+	c.SetLifetimeMultiplier(0)
+	if c.LifetimeMultiplier() != 1 {
+		t.Fatalf("unexpected %g", c.LifetimeMultiplier())
+	}
+
+	if e.Lifetime.D() != 30*time.Minute {
+		t.Fatal("existing entry changed")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestHistory(t *testing.T) {
+	c := NewWithConfig(&Config{HistorySize: 3})
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, 0)
+	c.Get(1, "a", "")
+	c.Get(2, "a", "")
+
+	events, ok := c.History("a")
+	if !ok || len(events) != 3 || events[0].Op != "commited" || events[2].ID != 2 || events[2].Op != "used" {
+		t.Fatalf("unexpected %v", events)
+	}
+
+	if _, ok := New().History("a"); ok {
+		t.Fatal("history without HistorySize")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestSoftEvict(t *testing.T) {
+	c := NewWithConfig(&Config{MaxBytes: 100, Shards: 1, SoftEvictBytes: true})
+
+	e, _, _ := c.Get(0, "a", "")
+	e.CommitEx(0, 1, 200, 0, &CommitOptions{Size: 10})
+
+	if !c.SoftEvict("a") || c.SoftEvict("a") {
+		t.Fatal("unexpected SoftEvict result")
+	}
+
+	if c.Len() != 1 || c.TotalBytes() != 0 {
+		t.Fatalf("len %d, bytes %d", c.Len(), c.TotalBytes())
+	}
+
+	e, _, _ = c.Get(0, "a", "")
+	if e == nil || e.NumberOfUpdates != 1 {
+		t.Fatal("expected elem for refill with kept stats")
+	}
+	e.CommitEx(0, 1, 200, 0, &CommitOptions{Size: 60})
+
+	e, _, _ = c.Get(0, "b", "")
+	e.CommitEx(0, 2, 200, 0, &CommitOptions{Size: 60})
+
+	if _, _, ok := c.Peek("a"); ok || c.Len() != 2 || c.TotalBytes() != 60 {
+		t.Fatalf("len %d, bytes %d", c.Len(), c.TotalBytes())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestDisableGC(t *testing.T) {
+	c := NewWithConfig(&Config{DisableGC: true, GCInterval: config.Duration(time.Millisecond), GCRetentionFactor: 1})
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, config.Duration(time.Millisecond))
+
+	time.Sleep(20 * time.Millisecond)
+	if c.Len() != 1 {
+		t.Fatal("removed without gc")
+	}
+
+	if n := c.DeleteExpired(); n != 1 {
+		t.Fatalf("removed %d", n)
+	}
+
+	c.Close()
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestStuckEntries(t *testing.T) {
+	c := New()
+
+	now := misc.NowUTC()
+	c.now = func() time.Time { return now }
+
+	e, _, _ := c.Get(0, "a", "")
+	defer e.Abort(0)
+
+	if list := c.StuckEntries(time.Minute); len(list) != 0 {
+		t.Fatalf("unexpected %v", list)
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	if list := c.StuckEntries(time.Minute); len(list) != 1 || list[0] != "a" {
+		t.Fatalf("unexpected %v", list)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestName(t *testing.T) {
+	c := NewWithConfig(&Config{Name: "users"})
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, 0)
+
+	st := c.GetStat()
+	if c.Name() != "users" || len(st) != 1 || st[0].Cache != "users" || st.Info()[0].Cache != "users" {
+		t.Fatalf("unexpected %+v", st)
+	}
+
+	if Global().Name() != "" || GetCache("synth-name").Name() != "synth-name" {
+		t.Fatal("unexpected names")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGrace(t *testing.T) {
+	c := NewWithConfig(&Config{Grace: config.Duration(time.Minute), GCRetentionFactor: 1})
+
+	now := misc.NowUTC()
+	c.now = func() time.Time { return now }
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, config.Duration(time.Minute))
+
+	now = now.Add(2 * time.Minute)
+
+	e, _, _ = c.Get(0, "a", "")
+	e.Abort(0) // backend недоступен
+
+	if e, data, _ := c.Get(0, "a", ""); e != nil || data != 1 {
+		t.Fatalf("expected stale data in grace, got %v", data)
+	}
+
+	if n := c.DeleteExpired(); n != 0 {
+		t.Fatal("removed in grace")
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	e, _, _ = c.Get(0, "a", "")
+	if e == nil {
+		t.Fatal("expected elem for retry")
+	}
+	e.Commit(0, 2, 200, config.Duration(time.Minute))
+
+	if e.inGrace(now) {
+		t.Fatal("grace not reset")
+	}
+
+	// Обновление не удалось, и ключ больше никому не нужен
+	now = now.Add(2 * time.Minute)
+	e, _, _ = c.Get(0, "a", "")
+	e.Abort(0)
+
+	now = now.Add(2 * time.Minute)
+	if n := c.DeleteExpired(); n != 1 {
+		t.Fatalf("abandoned element in grace must be removed after the retry time, removed %d", n)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestBatchCommit(t *testing.T) {
+	c := New()
+
+	r := c.BatchGet(0, []KeySpec{{Key: "a"}, {Key: "b"}, {Key: "c"}})
+
+	done := make(chan any, 1)
+	go func() {
+		_, data, _ := c.Get(0, "a", "")
+		done <- data
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	errs := c.BatchCommit(0, []CommitSpec{
+		{Elem: r[0].Elem, Data: 1, Code: 200},
+		{Hash: r[1].Elem.Hash, Data: 2, Code: 200},
+		{Hash: "unknown", Data: 3, Code: 200},
+	})
+	r[2].Elem.Abort(0)
+
+	if errs[0] != nil || errs[1] != nil || !errors.Is(errs[2], ErrNotInProgress) {
+		t.Fatalf("unexpected %v", errs)
+	}
+
+	if data := <-done; data != 1 {
+		t.Fatalf("waiter got %v", data)
+	}
+
+	if data, _, ok := c.Peek("b"); !ok || data != 2 {
+		t.Fatalf("unexpected %v", data)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCodec(t *testing.T) {
+	c := NewWithConfig(&Config{Codec: GzipCodec{}, CodecThreshold: 100})
+
+	big := bytes.Repeat([]byte("0123456789"), 100)
+
+	e, _, _ := c.Get(0, "big", "")
+	e.Commit(0, big, 200, 0)
+
+	if enc, ok := e.Data.(encodedData); !ok || len(enc) >= len(big) {
+		t.Fatalf("big data not encoded: %T", e.Data)
+	}
+
+	e, _, _ = c.Get(0, "small", "")
+	e.Commit(0, []byte("small"), 200, 0)
+
+	if _, ok := e.Data.([]byte); !ok {
+		t.Fatalf("small data encoded: %T", e.Data)
+	}
+
+	e, data, _ := c.Get(0, "big", "")
+	if e != nil || !bytes.Equal(data.([]byte), big) {
+		t.Fatal("unexpected big data")
+	}
+
+	st := c.GetStatWithData()
+	for _, s := range st {
+		if _, ok := s.Data.([]byte); !ok {
+			t.Fatalf("%s: unexpected %T", s.Key, s.Data)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGetEx(t *testing.T) {
+	c := New()
+
+	now := misc.NowUTC()
+	c.now = func() time.Time { return now }
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, config.Duration(time.Minute))
+
+	if _, data, _, stale := c.GetEx(0, "a", ""); data != 1 || stale {
+		t.Fatalf("expected fresh %v", data)
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	e, _, _, _ = c.GetEx(0, "a", "")
+	defer e.Abort(0)
+
+	if _, data, _, stale := c.GetEx(0, "a", ""); data != 1 || !stale {
+		t.Fatalf("expected stale %v", data)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestSubscribe(t *testing.T) {
+	c := New()
+
+	events, cancel := c.Subscribe()
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, 0)
+	c.Delete("a")
+
+	for _, op := range []EventOp{EventCommit, EventEvict} {
+		select {
+		case ev := <-events:
+			if ev.Op != op || ev.Key != "a" || ev.Code != 200 {
+				t.Fatalf("unexpected %+v", ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event", op)
+		}
+	}
+
+	cancel()
+	cancel()
+
+	if _, ok := <-events; ok {
+		t.Fatal("channel not closed")
+	}
+
+	events, _ = c.Subscribe()
+	c.Close()
+	if _, ok := <-events; ok {
+		t.Fatal("channel not closed by Close")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGetStatPage(t *testing.T) {
+	c := New()
+
+	for _, key := range []string{"d", "b", "a", "c", "e"} {
+		e, _, _ := c.Get(0, key, "")
+		e.Commit(0, 1, 200, 0)
+	}
+
+	page, total := c.GetStatPage(1, 2)
+	if total != 5 || len(page) != 2 || page[0].Key != "b" || page[1].Key != "c" {
+		t.Fatalf("unexpected %d %v", total, page)
+	}
+
+	if page, _ := c.GetStatPage(4, 10); len(page) != 1 || page[0].Key != "e" {
+		t.Fatalf("unexpected %v", page)
+	}
+
+	if page, total := c.GetStatPage(10, 10); len(page) != 0 || total != 5 {
+		t.Fatalf("unexpected %d %v", total, page)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGetCoalesced(t *testing.T) {
+	c := New()
+
+	owner, _, _ := c.GetCoalesced(0, "op", "a", "")
+	if owner == nil {
+		t.Fatal("expected elem")
+	}
+
+	done := make(chan any, 2)
+	for _, key := range []string{"b", "c"} {
+		go func(key string) {
+			e, data, _ := c.GetCoalesced(0, "op", key, "")
+			if e != nil {
+				e.Abort(0)
+			}
+			done <- data
+		}(key)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	owner.Commit(0, 1, 200, 0)
+
+	for i := 0; i < 2; i++ {
+		if data := <-done; data != 1 {
+			t.Fatalf("unexpected %v", data)
+		}
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if data, _, ok := c.Peek(key); !ok || data != 1 {
+			t.Fatalf("%s: unexpected %v", key, data)
+		}
+	}
+
+	// Отмена заполняющим - присоединившийся заполняет сам
+	owner, _, _ = c.GetCoalesced(0, "op", "x", "")
+	go func() {
+		e, _, _ := c.GetCoalesced(0, "op", "y", "")
+		if e != nil {
+			e.Commit(0, 2, 200, 0)
+		}
+		done <- nil
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	owner.Abort(0)
+	<-done
+
+	if data, _, ok := c.Peek("y"); !ok || data != 2 {
+		t.Fatalf("unexpected %v", data)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestTake(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, 0)
+
+	if data, code, ok := c.Take("a"); !ok || data != 1 || code != 200 {
+		t.Fatalf("unexpected %v %d %v", data, code, ok)
+	}
+
+	if _, _, ok := c.Take("a"); ok || c.Len() != 0 {
+		t.Fatal("taken twice")
+	}
+
+	busy, _, _ := c.Get(0, "b", "")
+	defer busy.Abort(0)
+
+	if _, _, ok := c.Take("b"); ok || c.Len() != 1 {
+		t.Fatal("in progress taken")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestStatsOrder(t *testing.T) {
+	c := New()
+
+	for i := 0; i < 20; i++ {
+		e, _, _ := c.Get(0, "a", "same", i)
+		e.Commit(0, i, 200, 0)
+	}
+
+	s1 := c.GetStat()
+	for n := 0; n < 5; n++ {
+		s2 := c.GetStat()
+		for i := range s1 {
+			if s1[i].Hash != s2[i].Hash {
+				t.Fatalf("order changed at %d", i)
+			}
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestShouldFill(t *testing.T) {
+	c := New()
+
+	now := misc.NowUTC()
+	c.now = func() time.Time { return now }
+
+	if !c.ShouldFill("a") || c.Len() != 0 {
+		t.Fatal("miss expected without creating")
+	}
+
+	e, _, _ := c.Get(0, "a", "")
+	if c.ShouldFill("a") {
+		t.Fatal("in progress")
+	}
+	e.Commit(0, 1, 200, config.Duration(time.Minute))
+
+	if c.ShouldFill("a") {
+		t.Fatal("fresh")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if !c.ShouldFill("a") {
+		t.Fatal("stale expected")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCodes(t *testing.T) {
+	c := New()
+
+	if _, code, ok := c.Peek("a"); ok || code != CodeNotFound {
+		t.Fatalf("Peek: %d %v", code, ok)
+	}
+	if _, code, _, ok := c.TryGet("a"); ok || code != CodeNotFound {
+		t.Fatalf("TryGet: %d %v", code, ok)
+	}
+	if _, code, ok := c.Take("a"); ok || code != CodeNotFound {
+		t.Fatalf("Take: %d %v", code, ok)
+	}
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, config.Duration(time.Minute))
+	if _, code, ok := c.Peek("a"); !ok || code != 200 || IsInternalCode(code) {
+		t.Fatalf("user code: %d %v", code, ok)
+	}
+
+	for _, code := range []int{CodeTimeout, CodeCanceled, CodeInProgress, CodeDeleted, CodeNotFound} {
+		if !IsInternalCode(code) {
+			t.Errorf("%d: internal expected", code)
+		}
+	}
+	if IsInternalCode(CodeOK) {
+		t.Error("CodeOK is not internal")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCreatedUpdatedBy(t *testing.T) {
+	c := New()
+
+	now := misc.NowUTC()
+	c.now = func() time.Time { return now }
+
+	e, _, _ := c.Get(7, "a", "")
+	e.Commit(7, 1, 0, config.Duration(time.Minute))
+
+	now = now.Add(2 * time.Minute)
+	e, _, _ = c.Get(9, "a", "")
+	e.Commit(9, 2, 0, config.Duration(time.Minute))
+
+	st := c.GetStat()[0]
+	if st.CreatedBy != 7 || st.LastUpdatedBy != 9 {
+		t.Fatalf("got %d/%d", st.CreatedBy, st.LastUpdatedBy)
+	}
+
+	if info := st.Info(now); info.CreatedBy != 7 || info.UpdatedBy != 9 {
+		t.Fatalf("info: %d/%d", info.CreatedBy, info.UpdatedBy)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestExpire(t *testing.T) {
+	c := New()
+
+	if c.Expire("a") {
+		t.Fatal("missing")
+	}
+
+	e, _, _ := c.Get(0, "a", "")
+	if c.Expire("a") {
+		t.Fatal("in progress")
+	}
+	e.Commit(0, 1, 0, LifetimeForever)
+
+	if !c.Expire("a") || c.Len() != 1 {
+		t.Fatal("expected to expire")
+	}
+
+	e, _, _ = c.Get(0, "a", "")
+	if e == nil {
+		t.Fatal("refill expected")
+	}
+
+	if _, data, _, stale := c.GetEx(1, "a", ""); data != 1 || !stale {
+		t.Fatalf("stale data expected, got %v %v", data, stale)
+	}
+
+	e.Commit(0, 2, 0, config.Duration(time.Minute))
+	if data, _, ok := c.Peek("a"); !ok || data != 2 {
+		t.Fatalf("got %v %v", data, ok)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestSaturatedCounters(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 0, LifetimeForever)
+
+	s := c.shard(e.hkey)
+	s.Lock()
+	e.NumberOfUses = math.MaxUint64 - 1
+	e.NumberOfUpdates = math.MaxUint64
+	s.unlock()
+
+	c.Get(0, "a", "")
+	c.Get(0, "a", "")
+
+	st := c.GetStat()
+	if st[0].NumberOfUses != math.MaxUint64 || st[0].NumberOfUpdates != math.MaxUint64 {
+		t.Fatalf("got %d/%d", st[0].NumberOfUses, st[0].NumberOfUpdates)
+	}
+
+	st = append(st, st[0])
+	if st.TotalUses() != math.MaxUint64 || st.TotalUpdates() != math.MaxUint64 {
+		t.Fatalf("totals: %d/%d", st.TotalUses(), st.TotalUpdates())
+	}
+
+	if _, uses, _ := c.Totals(); uses != math.MaxUint64 {
+		t.Fatalf("Totals: %d", uses)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestFillToken(t *testing.T) {
+	c := New()
+
+	e, token1, _, _ := c.GetWithToken(0, "a", "")
+	if e == nil || token1 == 0 || e.Token() != token1 {
+		t.Fatal("token expected")
+	}
+	e.Abort(0)
+	if e.Token() != 0 {
+		t.Fatal("no token after abort")
+	}
+
+	e, _, _ = c.Get(0, "a", "")
+	e.Commit(0, 1, 0, LifetimeForever)
+	c.Expire("a")
+
+	e, token2, _, _ := c.GetWithToken(0, "a", "")
+	if e == nil || token2 == token1 {
+		t.Fatalf("new token expected: %d %d", token1, token2)
+	}
+
+	// Устаревший владелец
+	if err := e.CommitEx(0, 2, 0, LifetimeForever, &CommitOptions{Token: token1}); !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("ErrNotOwner expected, got %v", err)
+	}
+	if err := e.AbortWithToken(0, token1); !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("ErrNotOwner expected, got %v", err)
+	}
+	if e.Token() != token2 {
+		t.Fatal("fill must stay in progress")
+	}
+
+	if err := e.CommitEx(0, 3, 0, LifetimeForever, &CommitOptions{Token: token2}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, ok := c.Peek("a"); !ok || data != 3 {
+		t.Fatalf("got %v %v", data, ok)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestShardDistribution(t *testing.T) {
+	c := NewWithConfig(&Config{Shards: 8})
+
+	const n = 10000
+	counts := make(map[*shard]int)
+	for i := 0; i < n; i++ {
+		hkey, _, _ := c.mustHash("key", []any{i})
+		counts[c.shard(hkey)]++
+	}
+
+	if len(counts) != 8 {
+		t.Fatalf("only %d shards used", len(counts))
+	}
+	for _, k := range counts {
+		if k < n/8/2 || k > n/8*2 {
+			t.Fatalf("bad distribution: %v", counts)
+		}
+	}
+
+	const max = 1000
+	c = NewWithConfig(&Config{Shards: 8, MaxEntries: max})
+	for i := 0; i < max; i++ {
+		e, _, _ := c.Get(0, fmt.Sprintf("k%d", i), "")
+		e.Commit(0, i, 0, LifetimeForever)
+	}
+
+	if k := c.Len(); k != max {
+		t.Fatalf("%d entries for MaxEntries %d", k, max)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestTakeNoEvict(t *testing.T) {
+	evicted := 0
+	c := NewWithConfig(&Config{OnEvict: func(key string, data any) { evicted++ }})
+
+	events, cancel := c.Subscribe()
+	defer cancel()
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 200, 0)
+	<-events // EventCommit
+
+	if data, _, ok := c.Take("a"); !ok || data != 1 {
+		t.Fatalf("got %v %v", data, ok)
+	}
+
+	if evicted != 0 {
+		t.Fatal("OnEvict called for taken data")
+	}
+
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected %+v", ev)
+	default:
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGetOrSetCommitError(t *testing.T) {
+	c := New()
+
+	data, _, err := c.GetOrSet(0, "a", "", func() (any, int, config.Duration, error) {
+		c.Delete("a")
+		return 1, 0, 0, nil
+	})
+	if !errors.Is(err, ErrDeleted) || data != 1 {
+		t.Fatalf("ErrDeleted expected, got %v %v", data, err)
+	}
+
+	if c.Len() != 0 {
+		t.Fatal("deleted element stored")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestExpireRetention(t *testing.T) {
+	c := NewWithConfig(&Config{DisableGC: true})
+
+	now := misc.NowUTC()
+	c.now = func() time.Time { return now }
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 0, LifetimeForever)
+	c.Expire("a")
+
+	now = now.Add(c.GCInterval())
+	if n := c.DeleteExpired(); n != 0 || c.Len() != 1 {
+		t.Fatalf("expired entry removed on the first pass (%d)", n)
+	}
+
+	now = now.Add(time.Duration(float64(c.GCInterval()) * DefaultGCRetentionFactor))
+	if n := c.DeleteExpired(); n != 1 {
+		t.Fatalf("expected removal, got %d", n)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestStatsClock(t *testing.T) {
+	c := New()
+
+	now := misc.NowUTC().Add(time.Hour)
+	c.now = func() time.Time { return now }
+
+	e, _, _ := c.Get(0, "a", "")
+	e.Commit(0, 1, 0, config.Duration(time.Minute))
+
+	now = now.Add(2 * time.Minute)
+
+	st := c.GetStat()
+	if st.Expired() != 1 {
+		t.Fatal("expired by the cache clock")
+	}
+	if info := st.Info(); !info[0].Expired || info[0].TTLSeconds != -60 {
+		t.Fatalf("unexpected %+v", info[0])
+	}
+	if len(c.GetStatFiltered(FilterExpired())) != 1 {
+		t.Fatal("FilterExpired must use the cache clock")
+	}
+
+	page, _ := c.GetStatPage(0, 0)
+	if page.Expired() != 1 {
+		t.Fatal("page must use the cache clock")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestUserNegativeCode(t *testing.T) {
+	c := New()
+
+	e, _, _ := c.Get(0, "a", "")
+	if err := e.Commit(0, "error", -1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, data, code := c.Get(0, "a", ""); e != nil || data != "error" || code != -1 {
+		t.Fatalf("user code must pass through: %v %v %d", e, data, code)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestGlobalLimits(t *testing.T) {
+	c := NewWithConfig(&Config{MaxBytes: 100, Shards: 8})
+
+	e, _, _ := c.Get(0, "a", "")
+	if err := e.CommitEx(0, "a", 200, 0, &CommitOptions{Size: 60}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c.Peek("a"); !ok || c.TotalBytes() != 60 {
+		t.Fatalf("entry that fits must stay, %d bytes", c.TotalBytes())
+	}
+
+	for i := 0; i < 20; i++ {
+		e, _, _ := c.Get(0, fmt.Sprintf("k%d", i), "")
+		e.CommitEx(0, i, 200, 0, &CommitOptions{Size: 30})
+		if n := c.TotalBytes(); n > 100 {
+			t.Fatalf("%d bytes over MaxBytes", n)
+		}
+	}
+	if _, _, ok := c.Peek("k19"); !ok || c.Len() != 3 {
+		t.Fatalf("last entry must stay, %d entries", c.Len())
+	}
+
+	c = NewWithConfig(&Config{MaxEntries: 4, Shards: 8})
+	for i := 0; i < 20; i++ {
+		e, _, _ := c.Get(0, fmt.Sprintf("k%d", i), "")
+		e.Commit(0, i, 200, 0)
+		if n := c.Len(); n > 4 {
+			t.Fatalf("%d entries over MaxEntries", n)
+		}
+	}
+	if c.Len() != 4 {
+		t.Fatalf("%d entries", c.Len())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestClearInProgress(t *testing.T) {
+	b := &testBackend{data: map[string]any{}}
+	committed := 0
+	c := NewWithConfig(&Config{Backend: b, OnCommit: func(st Stat, data any) { committed++ }})
+
+	e, _, _ := c.Get(0, "a", "")
+
+	const waiters = 3
+	done := make(chan int, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			e, _, code := c.Get(0, "a", "")
+			if e != nil {
+				e.Abort(0)
+			}
+			done <- code
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	c.Clear()
+
+	for i := 0; i < waiters; i++ {
+		select {
+		case code := <-done:
+			if code != CodeDeleted {
+				t.Fatalf("unexpected code %d", code)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("waiter is not woken up")
+		}
+	}
+
+	if err := e.Commit(0, 1, 200, 0); !errors.Is(err, ErrDeleted) {
+		t.Fatalf("unexpected %v", err)
+	}
+
+	if committed != 0 || len(b.data) != 0 || c.Len() != 0 {
+		t.Fatalf("cleared fill is stored: %d commits, %d in backend, %d entries", committed, len(b.data), c.Len())
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestConfigCheck(t *testing.T) {
+	for name, cfg := range map[string]*Config{
+		"gc-interval":          {GCInterval: config.Duration(-time.Second)},
+		"gc-retention-factor":  {GCRetentionFactor: 0.5},
+		"default-lifetime":     {DefaultLifetime: config.Duration(-time.Second)},
+		"max-entries":          {MaxEntries: -1},
+		"jitter-fraction":      {JitterFraction: 1},
+		"eviction-policy":      {EvictionPolicy: "random"},
+		"shards":               {Shards: -1},
+		"max-concurrent-fills": {MaxConcurrentFills: -1},
+	} {
+		err := cfg.Check(nil)
+		if err == nil || !strings.Contains(err.Error(), "cache."+name) {
+			t.Errorf("%s: unexpected %v", name, err)
+		}
+	}
+
+	if err := (&Config{JitterFraction: -0.1}).Check(nil); err == nil {
+		t.Error("negative jitter-fraction accepted")
+	}
+
+	cfg := &Config{JitterFraction: 0.5, EvictionPolicy: EvictionLFU}
+	if err := cfg.Check(nil); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GCInterval != DefaultGCInterval || cfg.GCRetentionFactor != DefaultGCRetentionFactor || cfg.Shards <= 0 {
+		t.Fatalf("defaults are not set: %+v", cfg)
+	}
+}
+
+type testAppConfig struct {
+	cache *Config
+}
+
+func (x *testAppConfig) CacheConfig() *Config {
+	return x.cache
+}
+
+func TestInitModule(t *testing.T) {
+	old := storage.Load()
+	t.Cleanup(func() {
+		storage.Load().Close()
+		storage.Store(old)
+	})
+
+	if err := initModule(&testAppConfig{cache: &Config{MaxEntries: -1}}, nil); err == nil {
+		t.Fatal("bad config accepted")
+	}
+
+	if err := initModule(&testAppConfig{cache: &Config{Name: "app", MaxEntries: 10}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c := Global(); c.Name() != "app" || c.maxEntries != 10 {
+		t.Fatalf("global cache is not configured: %s %d", c.Name(), c.maxEntries)
+	}
+	Global().Close()
+
+	if err := initModule(struct{}{}, nil); err != nil || Global().Name() != "" {
+		t.Fatalf("defaults expected without AppConfig: %v", err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
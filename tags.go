@@ -0,0 +1,91 @@
+package cache
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Удалить все элементы с тегом tag. Возвращает количество удалённых.
+// Теги задаются при Commit, поэтому элемент, заполняемый впервые, тегов ещё не имеет и не удаляется.
+// Элемент с тегом, находящийся в процессе обновления, удаляется как при Delete
+// (результат текущего обновления в кеш не попадёт, Commit вернёт ErrDeleted)
+func InvalidateTag(tag string) int {
+	return Global().InvalidateTag(tag)
+}
+
+func (c *Cache) InvalidateTag(tag string) (n int) {
+	var hashes []string
+
+	c.forEachShard(func(s *shard) {
+		n += s.invalidateTag(tag, &hashes)
+	})
+
+	c.publishInvalidation(hashes, []string{tag})
+	return
+}
+
+// Удаление элементов с тегом, вызывается под блокировкой. hash удалённых добавляются в hashes, если он не nil
+func (s *shard) invalidateTag(tag string, hashes *[]string) (n int) {
+	for _, e := range s.tags[tag] {
+		s.delete(e)
+		e.debug(0, "invalidated by tag")
+		if hashes != nil {
+			*hashes = append(*hashes, e.Hash)
+		}
+		n++
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Замена тегов элемента, вызывается под блокировкой
+func (s *shard) setTags(e *Elem, tags []string) {
+	s.unindexTags(e)
+
+	e.Tags = nil
+	if len(tags) == 0 {
+		return
+	}
+
+	e.Tags = make([]string, 0, len(tags))
+	seen := make(map[string]struct{}, len(tags))
+
+	for _, tag := range tags {
+		if _, exists := seen[tag]; exists {
+			continue
+		}
+		seen[tag] = struct{}{}
+		e.Tags = append(e.Tags, tag)
+	}
+
+	if s.data[e.hkey] != e {
+		// Элемент уже удалён из хранилища
+		return
+	}
+
+	for _, tag := range e.Tags {
+		list, exists := s.tags[tag]
+		if !exists {
+			list = make(map[hashKey]*Elem)
+			s.tags[tag] = list
+		}
+
+		list[e.hkey] = e
+	}
+}
+
+// Удаление элемента из индекса тегов
+func (s *shard) unindexTags(e *Elem) {
+	for _, tag := range e.Tags {
+		list := s.tags[tag]
+		if list[e.hkey] != e {
+			continue
+		}
+
+		delete(list, e.hkey)
+		if len(list) == 0 {
+			delete(s.tags, tag)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
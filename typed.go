@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alrusov/config"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Типизированная обёртка над кешем, данные всегда типа T
+	TypedCache[T any] struct {
+		cache *Cache
+	}
+
+	// Типизированная обёртка над элементом, требующим заполнения
+	TypedElem[T any] struct {
+		elem *Elem
+	}
+)
+
+var (
+	// Данные в кеше имеют не тот тип
+	ErrTypeMismatch = errors.New("cached data type mismatch")
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Типизированная обёртка над c, nil - над глобальным кешем
+func NewTyped[T any](c *Cache) *TypedCache[T] {
+	if c == nil {
+		c = Global()
+	}
+
+	return &TypedCache[T]{
+		cache: c,
+	}
+}
+
+// Исходный кеш
+func (tc *TypedCache[T]) Cache() *Cache {
+	return tc.cache
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// См. Cache.Get. Если в кеше лежат данные другого типа, то возвращается ErrTypeMismatch
+func (tc *TypedCache[T]) Get(id uint64, key string, description string, extra ...any) (e *TypedElem[T], data T, code int, err error) {
+	return tc.wrap(tc.cache.Get(id, key, description, extra...))
+}
+
+// См. Cache.GetWithTimeout
+func (tc *TypedCache[T]) GetWithTimeout(id uint64, timeout time.Duration, key string, description string, extra ...any) (e *TypedElem[T], data T, code int, err error) {
+	return tc.wrap(tc.cache.GetWithTimeout(id, timeout, key, description, extra...))
+}
+
+// См. Cache.GetContext
+func (tc *TypedCache[T]) GetContext(ctx context.Context, id uint64, key string, description string, extra ...any) (e *TypedElem[T], data T, code int, err error) {
+	src, srcData, code, err := tc.cache.GetContext(ctx, id, key, description, extra...)
+	if err != nil {
+		return
+	}
+
+	return tc.wrap(src, srcData, code)
+}
+
+// См. Cache.Peek
+func (tc *TypedCache[T]) Peek(key string, extra ...any) (data T, code int, ok bool, err error) {
+	src, code, ok := tc.cache.Peek(key, extra...)
+	if !ok {
+		return
+	}
+
+	data, err = cast[T](src)
+	return
+}
+
+func (tc *TypedCache[T]) wrap(src *Elem, srcData any, code int) (e *TypedElem[T], data T, _ int, err error) {
+	if src != nil {
+		e = &TypedElem[T]{
+			elem: src,
+		}
+	}
+
+	data, err = cast[T](srcData)
+	return e, data, code, err
+}
+
+func cast[T any](src any) (data T, err error) {
+	if src == nil {
+		return
+	}
+
+	data, ok := src.(T)
+	if !ok {
+		err = fmt.Errorf("%w: %T instead of %T", ErrTypeMismatch, src, data)
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Исходный элемент
+func (e *TypedElem[T]) Elem() *Elem {
+	return e.elem
+}
+
+// См. Elem.Commit
+func (e *TypedElem[T]) Commit(id uint64, data T, code int, lifetime config.Duration) error {
+	return e.elem.Commit(id, data, code, lifetime)
+}
+
+// См. Elem.Abort
+func (e *TypedElem[T]) Abort(id uint64) {
+	e.elem.Abort(id)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"context"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Ожидание первого заполнения элемента, например, при прогреве кеша при старте. В отличие от Get элемент не создаётся
+// и на заполнение не отдаётся: ждём, пока его заполнит кто-то другой (через Get, Preload, LoadSnapshot и т.п.).
+// Если элемент уже заполнен (даже если устарел), возвращает nil сразу.
+// Возвращает ctx.Err() при отмене ctx, ErrHash, если невозможно вычислить hash, ErrClosed для закрытого кеша
+func WaitFilled(ctx context.Context, key string, extra ...any) error {
+	return Global().WaitFilled(ctx, key, extra...)
+}
+
+func (c *Cache) WaitFilled(ctx context.Context, key string, extra ...any) error {
+	hkey, _, check, err := c.makeHash(key, extra)
+	if err != nil {
+		return err
+	}
+
+	s := c.shard(hkey)
+	s.Lock()
+	defer s.unlock()
+
+	stop := context.AfterFunc(ctx, func() {
+		s.Lock()
+		s.filled.Broadcast()
+		s.Unlock()
+	})
+	defer stop()
+
+	for {
+		if e, exists := s.data[hkey]; exists && e.matches(key, check) && e.Filled {
+			return nil
+		}
+
+		if c.closed.Load() {
+			return ErrClosed
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s.fillWaiters++
+		s.filled.Wait()
+		s.fillWaiters--
+	}
+}
+
+// Сигнал ожидающим в WaitFilled, вызывается под блокировкой
+func (s *shard) notifyFilled() {
+	if s.fillWaiters > 0 {
+		s.filled.Broadcast()
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//